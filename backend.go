@@ -0,0 +1,32 @@
+package redisq
+
+import (
+	"time"
+)
+
+// Storage of the tasks used by Worker and FailureWorker
+// RedisClient is the Redis implementation, MemoryBackend keeps the tasks in memory (for tests and local development)
+type Backend interface {
+	// type of the tasks stored
+	TaskType() string
+	// creates a new task and puts it to the queue, returns uuid of the created task
+	EnqueueTask(args []string, opts *EnqueueOptions) (string, error)
+	// moves an item from the list to another one, waits until there is one
+	PickTask(from, to string) (string, error)
+	// as PickTask, but waits up to timeout, returns an empty string if there is no item
+	PickTaskTimeout(from, to string, timeout time.Duration) (string, error)
+	// moves an item from the first non-empty list to another one, returns an empty string if all are empty
+	PickTaskFromLists(from []string, to string) (string, error)
+	GetTaskDetails(uuid string) (*TaskDetails, error)
+	SaveTaskDetails(uuid string, taskDetails *TaskDetails) error
+	PushTaskToList(uuid string, list string) error
+	DeleteTask(uuid string) error
+	RemoveOneFromList(uuid, listName string) error
+	// atomically applies a transition of a task leaving its processing list
+	FinishTask(uuid string, t *Transition) error
+	SetTaskOwner(uuid, ownerId string) error
+	SetLease(uuid, processing string, deadline time.Time) error
+	RenewLease(uuid, processing string, deadline time.Time) error
+	// moves up to limit scheduled tasks and retries due at the given time to the queues, returns amount of moved tasks
+	PromoteScheduledTasks(now time.Time, limit int) (int, error)
+}
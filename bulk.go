@@ -0,0 +1,129 @@
+package redisq
+
+import (
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+)
+
+// default amount of tasks sent to redis within a single transaction
+const DEFAULT_BULK_CHUNK_SIZE = 500
+
+// A task to be created by EnqueueTasks
+type BulkTask struct {
+	Arguments []string
+	Options   *EnqueueOptions
+}
+
+// Outcome of a single task created by EnqueueTasks
+type BulkResult struct {
+	UUID string
+	Err  error
+}
+
+// creates many tasks at once, pipelining them in chunks of chunkSize tasks
+// (each chunk is a single transaction), results are in the same order as tasks
+func (rc *RedisClient) EnqueueTasks(tasks []BulkTask, chunkSize int) []BulkResult {
+	if chunkSize <= 0 {
+		chunkSize = DEFAULT_BULK_CHUNK_SIZE
+	}
+
+	results := make([]BulkResult, len(tasks))
+
+	// the chunks call the script by its hash
+	if err := enqueueScript.Load(rc.conn); err != nil {
+		for i := range results {
+			results[i].Err = err
+		}
+		return results
+	}
+
+	for start := 0; start < len(tasks); start += chunkSize {
+		end := start + chunkSize
+		if end > len(tasks) {
+			end = len(tasks)
+		}
+
+		rc.enqueueChunk(tasks[start:end], results[start:end])
+	}
+
+	return results
+}
+
+// stores the tasks of a chunk within a transaction, a failing task is never stored half way and does not affect the others
+func (rc *RedisClient) enqueueChunk(tasks []BulkTask, results []BulkResult) {
+	// tasks that are sent and their indexes
+	var sent []*preparedTask
+	var indexes []int
+
+	for i, task := range tasks {
+		prepared, err := rc.prepareTask(task.Arguments, task.Options)
+		if err != nil {
+			results[i] = BulkResult{Err: err}
+			continue
+		}
+
+		results[i] = BulkResult{UUID: prepared.uuid}
+		sent = append(sent, prepared)
+		indexes = append(indexes, i)
+	}
+
+	if len(sent) == 0 {
+		return
+	}
+
+	replies, err := rc.execEnqueue(sent)
+	if isNoScript(err) {
+		// the scripts have been flushed meanwhile (e.g. on a failover)
+		if err = enqueueScript.Load(rc.conn); err == nil {
+			replies, err = rc.execEnqueue(sent)
+		}
+	}
+
+	if err != nil {
+		for _, i := range indexes {
+			results[i].Err = err
+		}
+		return
+	}
+
+	for n, task := range sent {
+		i := indexes[n]
+		results[i].UUID, results[i].Err = rc.checkEnqueueReply(task, replies[n], nil)
+	}
+}
+
+// runs the enqueue script of every task within MULTI/EXEC, returns a reply per task
+func (rc *RedisClient) execEnqueue(tasks []*preparedTask) ([]interface{}, error) {
+	if err := rc.conn.Send("MULTI"); err != nil {
+		return nil, err
+	}
+
+	for _, task := range tasks {
+		if err := enqueueScript.SendHash(rc.conn, rc.enqueueArgs(task)...); err != nil {
+			return nil, err
+		}
+	}
+
+	replies, err := redis.Values(rc.conn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(replies) != len(tasks) {
+		return nil, errors.New("Unexpected amount of EXEC replies")
+	}
+
+	// the script is missing for all the tasks at once
+	if len(replies) > 0 && isNoScript(replies[0]) {
+		return nil, replies[0].(redis.Error)
+	}
+
+	return replies, nil
+}
+
+func isNoScript(reply interface{}) bool {
+	err, ok := reply.(redis.Error)
+
+	return ok && strings.HasPrefix(string(err), "NOSCRIPT")
+}
@@ -0,0 +1,84 @@
+package redisq
+
+import (
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"testing"
+)
+
+func TestRedisClient_EnqueueTasks(t *testing.T) {
+	conn := redigomock.NewConn()
+	load := conn.GenericCommand("SCRIPT").Expect([]byte(enqueueScript.Hash()))
+	conn.Command("EXEC").
+		ExpectSlice([]byte("foo_uuid"), []byte("bar_uuid")).
+		ExpectSlice(redis.Error("WRONGTYPE"))
+
+	tasks := []BulkTask{
+		{Arguments: []string{"foo"}},
+		{Arguments: []string{"bar"}},
+		{Arguments: []string{"baz"}, Options: &EnqueueOptions{UUID: CLIENT_TASK_UUID}},
+	}
+
+	client := getRedisClient(conn)
+	results := client.EnqueueTasks(tasks, 2)
+
+	if len(results) != len(tasks) {
+		t.Fatalf("Expected %d results, got %d", len(tasks), len(results))
+	}
+
+	for i, result := range results[:2] {
+		if result.Err != nil || result.UUID == "" {
+			t.Errorf("Task %d is expected to be enqueued, got %+v", i, result)
+		}
+	}
+
+	if results[2].UUID != CLIENT_TASK_UUID || results[2].Err == nil {
+		t.Errorf("Task 2 is expected to fail, got %+v", results[2])
+	}
+
+	if conn.Stats(load) != 1 {
+		t.Error("Script is expected to be loaded before the chunks are sent")
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestRedisClient_EnqueueTasks_ConnectionLost(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.GenericCommand("SCRIPT").Expect([]byte(enqueueScript.Hash()))
+	conn.Command("EXEC").ExpectError(errors.New("connection lost"))
+
+	client := getRedisClient(conn)
+	results := client.EnqueueTasks([]BulkTask{{Arguments: []string{"foo"}}, {Arguments: []string{"bar"}}}, 0)
+
+	for i, result := range results {
+		if result.Err == nil {
+			t.Errorf("Task %d is expected to fail", i)
+		}
+	}
+}
+
+func TestRedisClient_EnqueueTasks_NoScript(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.GenericCommand("SCRIPT").Expect([]byte(enqueueScript.Hash()))
+	// the scripts are flushed between loading and the chunk
+	conn.Command("EXEC").
+		ExpectSlice(redis.Error("NOSCRIPT No matching script"), redis.Error("NOSCRIPT No matching script")).
+		ExpectSlice([]byte("foo_uuid"), []byte("bar_uuid"))
+
+	client := getRedisClient(conn)
+	results := client.EnqueueTasks([]BulkTask{{Arguments: []string{"foo"}}, {Arguments: []string{"bar"}}}, 0)
+
+	for i, result := range results {
+		if result.Err != nil || result.UUID == "" {
+			t.Errorf("Task %d is expected to be enqueued once the script is loaded again, got %+v", i, result)
+		}
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
@@ -15,15 +15,44 @@ const (
 	LIST_FAILURE_FINAL      = "failure_final"
 	LIST_PROCESSING         = "processing"
 	LIST_FAILURE_PROCESSING = "failure_processing"
+	LIST_EXPIRED            = "expired"
 )
 
+// stores a task and pushes it to the queue KEYS[2] (or adds it to the KEYS[2] schedule scored ARGV[3],
+// if it is not empty), unless the unique key KEYS[3] (if given) is taken, returns uuid of the task holding
+// the unique key; nothing is written if KEYS[2] has a wrong type, so that a task is never stored half way
+var enqueueScript = redis.NewScript(-1, `
+local kind = redis.call("TYPE", KEYS[2]).ok
+if kind ~= "none" and kind ~= (ARGV[3] == "" and "list" or "zset") then
+	return redis.error_reply("WRONGTYPE " .. KEYS[2] .. " holds a " .. kind)
+end
+if KEYS[3] and not redis.call("SET", KEYS[3], ARGV[1], "NX", "PX", ARGV[4]) then
+	return redis.call("GET", KEYS[3])
+end
+redis.call("SET", KEYS[1], ARGV[2])
+if ARGV[3] == "" then
+	redis.call("LPUSH", KEYS[2], ARGV[1])
+else
+	redis.call("ZADD", KEYS[2], ARGV[3], ARGV[1])
+end
+return ARGV[1]
+`)
+
 type TaskDetails struct {
-	Arguments   []string `json:"arguments"`
-	CreatedAt   string   `json:"createdAt"`
-	Attempts    int      `json:"attempts"`
-	Type        string   `json:"type"`
-	LastAttempt string   `json:"lastAttempt"`
-	LastError   string   `json:"lastError"`
+	Arguments         []string        `json:"arguments"`
+	CreatedAt         string          `json:"createdAt"`
+	Attempts          int             `json:"attempts"`
+	Type              string          `json:"type"`
+	LastAttempt       string          `json:"lastAttempt"`
+	LastError         string          `json:"lastError"`
+	Priority          string          `json:"priority,omitempty"`
+	UniqueKey         string          `json:"uniqueKey,omitempty"`
+	ExpiresAt         string          `json:"expiresAt,omitempty"`
+	Payload           json.RawMessage `json:"payload,omitempty"`
+	StoreResult       bool            `json:"storeResult,omitempty"`
+	VisibilityTimeout int             `json:"visibilityTimeout,omitempty"` // ms
+	RetryPolicy       string          `json:"retryPolicy,omitempty"`
+	Timeout           int             `json:"timeout,omitempty"` // ms
 }
 
 // increments attempts and updates `LastAttempt` property to the current date
@@ -32,10 +61,29 @@ func (td *TaskDetails) NewAttempt() {
 	td.LastAttempt = time.Now().UTC().Format(time.RFC3339)
 }
 
+// checks whether the task deadline has passed (tasks without a deadline never expire)
+func (td *TaskDetails) IsExpired(now time.Time) bool {
+	if td.ExpiresAt == "" {
+		return false
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, td.ExpiresAt)
+	if err != nil {
+		return false
+	}
+
+	return !now.Before(expiresAt)
+}
+
 type RedisClient struct {
 	conn     redis.Conn
 	prefix   string
 	taskType string
+	// used to encode task details, tasks are decoded with the codec they were encoded with
+	Codec Codec
+	// wraps the task type in a hash tag (its braces escaped), so that all the keys of a task type land on one Redis Cluster slot
+	// (the keys differ from the ones used otherwise)
+	Cluster bool
 }
 
 func NewRedisClient(conn redis.Conn, prefix, taskType string) *RedisClient {
@@ -43,15 +91,192 @@ func NewRedisClient(conn redis.Conn, prefix, taskType string) *RedisClient {
 		conn:     conn,
 		prefix:   prefix,
 		taskType: taskType,
+		Codec:    &JSONCodec{},
+	}
+}
+
+// Options that can be passed to EnqueueTask
+type EnqueueOptions struct {
+	// UUID of the new task, it is generated if empty
+	UUID string
+	// one of PRIORITY_* constants, normal priority if empty
+	Priority string
+	// rejects the task while another one with the same key is pending or processing
+	UniqueKey string
+	// how long the unique key is held at most, DEFAULT_UNIQUE_TTL if zero
+	UniqueTTL time.Duration
+	// the task is moved to the expired list instead of being run after this time (if not zero)
+	ExpiresAt time.Time
+	// structured task arguments, encoded as json (decoded by HandlerFunc)
+	Payload interface{}
+	// keeps the task result for the producer, see GetResult and AwaitResult
+	StoreResult bool
+	// the task is returned to the queue if the handler does not finish or renew its lease in time
+	// (overrides Worker.VisibilityTimeout, if not zero)
+	VisibilityTimeout time.Duration
+	// name of a retry policy registered in Daemon.RetryPolicies, overrides Daemon.RetryPolicy
+	RetryPolicy string
+	// deadline of a ContextTaskHandler call (overrides Worker.HandlerTimeout, if not zero)
+	Timeout time.Duration
+}
+
+// task type part of the keys
+func (rc *RedisClient) typeKey() string {
+	if rc.Cluster {
+		return "{" + hashTag(rc.taskType) + "}"
+	}
+
+	return rc.taskType
+}
+
+// type of the tasks stored
+func (rc *RedisClient) TaskType() string {
+	return rc.taskType
+}
+
+// redis key of a list for the current task type
+func (rc *RedisClient) listKey(list string) string {
+	return fmt.Sprintf("%s:%s:%s", rc.prefix, list, rc.typeKey())
+}
+
+// redis key of the task details for a given task uuid
+func (rc *RedisClient) taskKey(uuid string) string {
+	return fmt.Sprintf("%s:%s:%s:%s", rc.prefix, QUEUE_TASK, rc.typeKey(), uuid)
+}
+
+// a new task ready to be stored
+type preparedTask struct {
+	uuid      string
+	details   *TaskDetails
+	data      []byte
+	uniqueTTL time.Duration
+	// the task is scheduled, if not zero
+	runAt time.Time
+}
+
+// builds and encodes details of a new task
+func (rc *RedisClient) prepareTask(args []string, opts *EnqueueOptions) (*preparedTask, error) {
+	return prepareTask(rc.Codec, rc.taskType, args, opts)
+}
+
+// builds and encodes details of a new task of the type
+func prepareTask(codec Codec, taskType string, args []string, opts *EnqueueOptions) (*preparedTask, error) {
+	if opts == nil {
+		opts = &EnqueueOptions{}
+	}
+
+	if !isValidPriority(opts.Priority) {
+		return nil, fmt.Errorf("Unknown task priority \"%s\"", opts.Priority)
+	}
+
+	uuid := opts.UUID
+	if uuid == "" {
+		var err error
+		if uuid, err = newUUID(); err != nil {
+			return nil, err
+		}
+	}
+
+	taskDetails := &TaskDetails{
+		Arguments:         args,
+		CreatedAt:         time.Now().UTC().Format(time.RFC3339),
+		Type:              taskType,
+		Priority:          opts.Priority,
+		UniqueKey:         opts.UniqueKey,
+		StoreResult:       opts.StoreResult,
+		VisibilityTimeout: int(opts.VisibilityTimeout / time.Millisecond),
+		RetryPolicy:       opts.RetryPolicy,
+		Timeout:           int(opts.Timeout / time.Millisecond),
+	}
+
+	if !opts.ExpiresAt.IsZero() {
+		taskDetails.ExpiresAt = opts.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+
+	if opts.Payload != nil {
+		payload, err := json.Marshal(opts.Payload)
+		if err != nil {
+			return nil, err
+		}
+		taskDetails.Payload = payload
 	}
+
+	taskJson, err := codec.Marshal(taskDetails)
+	if err != nil {
+		return nil, err
+	}
+
+	uniqueTTL := opts.UniqueTTL
+	if uniqueTTL <= 0 {
+		uniqueTTL = DEFAULT_UNIQUE_TTL
+	}
+
+	return &preparedTask{
+		uuid:      uuid,
+		details:   taskDetails,
+		data:      taskJson,
+		uniqueTTL: uniqueTTL,
+	}, nil
+}
+
+// keys and arguments of enqueueScript storing the task
+func (rc *RedisClient) enqueueArgs(task *preparedTask) []interface{} {
+	target := rc.listKey(priorityList(LIST_QUEUE, task.details.Priority))
+	score := ""
+	if !task.runAt.IsZero() {
+		target = rc.listKey(priorityList(ZSET_SCHEDULED, task.details.Priority))
+		score = fmt.Sprintf("%d", timeToScore(task.runAt))
+	}
+
+	keys := []interface{}{rc.taskKey(task.uuid), target}
+	if task.details.UniqueKey != "" {
+		keys = append(keys, rc.uniqueKey(task.details.UniqueKey))
+	}
+
+	args := append([]interface{}{len(keys)}, keys...)
+
+	return append(args, task.uuid, task.data, score, int64(task.uniqueTTL/time.Millisecond))
+}
+
+// checks a reply of enqueueScript, returns uuid of the stored task (or of its pending duplicate)
+func (rc *RedisClient) checkEnqueueReply(task *preparedTask, reply interface{}, err error) (string, error) {
+	uuid, err := redis.String(reply, err)
+	if err != nil {
+		return task.uuid, err
+	}
+
+	// only a unique task can be rejected
+	if task.details.UniqueKey != "" && uuid != task.uuid {
+		return uuid, ErrDuplicateTask
+	}
+
+	return task.uuid, nil
+}
+
+// stores a new task by a single script, so that it is never stored half way
+func (rc *RedisClient) storeTask(task *preparedTask) (string, error) {
+	reply, err := enqueueScript.Do(rc.conn, rc.enqueueArgs(task)...)
+
+	return rc.checkEnqueueReply(task, reply, err)
+}
+
+// creates a new task and atomically puts it to the queue, returns uuid of the created task
+// If a task with the same UniqueKey is pending, its uuid is returned along with ErrDuplicateTask
+func (rc *RedisClient) EnqueueTask(args []string, opts *EnqueueOptions) (string, error) {
+	task, err := rc.prepareTask(args, opts)
+	if err != nil {
+		return "", err
+	}
+
+	return rc.storeTask(task)
 }
 
 // pick an item from the queue
 func (rc *RedisClient) PickTask(from, to string) (string, error) {
 	result, err := rc.conn.Do(
 		"BRPOPLPUSH",
-		fmt.Sprintf("%s:%s:%s", rc.prefix, from, rc.taskType),
-		fmt.Sprintf("%s:%s:%s", rc.prefix, to, rc.taskType),
+		rc.listKey(from),
+		rc.listKey(to),
 		0,
 	)
 
@@ -68,9 +293,30 @@ func (rc *RedisClient) PickTask(from, to string) (string, error) {
 	return string(uuid), nil
 }
 
+// pick an item from the queue, waits up to timeout (rounded to seconds) for one,
+// returns an empty string if there is none
+func (rc *RedisClient) PickTaskTimeout(from, to string, timeout time.Duration) (string, error) {
+	seconds := int64(timeout / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	uuid, err := redis.String(rc.conn.Do(
+		"BRPOPLPUSH",
+		rc.listKey(from),
+		rc.listKey(to),
+		seconds,
+	))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+
+	return uuid, err
+}
+
 // get task details for a given task uuid
 func (rc *RedisClient) GetTaskDetails(uuid string) (*TaskDetails, error) {
-	taskResult, err := rc.conn.Do("GET", fmt.Sprintf("%s:%s:%s:%s", rc.prefix, QUEUE_TASK, rc.taskType, uuid))
+	taskResult, err := rc.conn.Do("GET", rc.taskKey(uuid))
 	if err != nil {
 		return nil, err
 	}
@@ -82,7 +328,7 @@ func (rc *RedisClient) GetTaskDetails(uuid string) (*TaskDetails, error) {
 	}
 
 	var taskDetails TaskDetails
-	err = json.Unmarshal(taskJson, &taskDetails)
+	err = decodeTaskDetails(taskJson, &taskDetails)
 	if err != nil {
 		return nil, err
 	}
@@ -91,29 +337,29 @@ func (rc *RedisClient) GetTaskDetails(uuid string) (*TaskDetails, error) {
 }
 
 func (rc *RedisClient) PushTaskToList(uuid string, list string) error {
-	_, err := rc.conn.Do("LPUSH", fmt.Sprintf("%s:%s:%s", rc.prefix, list, rc.taskType), uuid)
+	_, err := rc.conn.Do("LPUSH", rc.listKey(list), uuid)
 
 	return err
 }
 
 func (rc *RedisClient) SaveTaskDetails(uuid string, taskDetails *TaskDetails) error {
-	newResult, err := json.Marshal(taskDetails)
+	newResult, err := rc.Codec.Marshal(taskDetails)
 
 	if err == nil {
-		_, err = rc.conn.Do("SET", fmt.Sprintf("%s:%s:%s:%s", rc.prefix, QUEUE_TASK, rc.taskType, uuid), newResult)
+		_, err = rc.conn.Do("SET", rc.taskKey(uuid), newResult)
 	}
 
 	return err
 }
 
 func (rc *RedisClient) DeleteTask(uuid string) error {
-	_, err := rc.conn.Do("DEL", fmt.Sprintf("%s:%s:%s:%s", rc.prefix, QUEUE_TASK, rc.taskType, uuid))
+	_, err := rc.conn.Do("DEL", rc.taskKey(uuid))
 
 	return err
 }
 
 func (rc *RedisClient) RemoveOneFromList(uuid, listName string) error {
-	_, err := rc.conn.Do("LREM", fmt.Sprintf("%s:%s:%s", rc.prefix, listName, rc.taskType), 1, uuid)
+	_, err := rc.conn.Do("LREM", rc.listKey(listName), 1, uuid)
 
 	return err
 }
@@ -6,6 +6,7 @@ import (
 	"github.com/rafaeljusto/redigomock"
 	"reflect"
 	"testing"
+	"time"
 )
 
 const (
@@ -53,6 +54,63 @@ func TestRedisClient_NewTask(t *testing.T) {
 	}
 }
 
+func TestRedisClient_PickTaskTimeout(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("BRPOPLPUSH",
+		fmt.Sprintf("%s:%s:%s", CLIENT_REDIS_PREFIX, "from", CLIENT_TASK_TYPE),
+		fmt.Sprintf("%s:%s:%s", CLIENT_REDIS_PREFIX, "to", CLIENT_TASK_TYPE),
+		int64(1),
+	).Expect(nil)
+
+	client := getRedisClient(conn)
+	uuid, err := client.PickTaskTimeout("from", "to", time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uuid != "" {
+		t.Errorf("Expected no task, got %+v", uuid)
+		t.FailNow()
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestRedisClient_EnqueueTask(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.GenericCommand("EVALSHA").Expect([]byte(CLIENT_TASK_UUID))
+
+	client := getRedisClient(conn)
+	uuid, err := client.EnqueueTask([]string{"foo", "bar"}, &EnqueueOptions{UUID: CLIENT_TASK_UUID})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uuid != CLIENT_TASK_UUID {
+		t.Errorf("Expected %+v got %+v", CLIENT_TASK_UUID, uuid)
+		t.FailNow()
+	}
+
+	uuid, err = client.EnqueueTask([]string{"foo", "bar"}, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(uuid) != 36 {
+		t.Errorf("Expected a generated uuid, got %+v", uuid)
+		t.FailNow()
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
 func TestRedisClient_GetTaskDetails(t *testing.T) {
 	originalTaskDetails := getClientTaskDetails()
 	jsonTaskDetails, err := json.Marshal(originalTaskDetails)
@@ -179,3 +237,22 @@ func TestTaskDetails_NewAttempt(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestTaskDetails_IsExpired(t *testing.T) {
+	td := getClientTaskDetails()
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	if td.IsExpired(now) {
+		t.Error("A task without ExpiresAt is not expected to expire")
+	}
+
+	td.ExpiresAt = now.Add(time.Minute).Format(time.RFC3339)
+	if td.IsExpired(now) {
+		t.Error("A task is not expected to expire before ExpiresAt")
+	}
+
+	td.ExpiresAt = now.Add(-time.Minute).Format(time.RFC3339)
+	if !td.IsExpired(now) {
+		t.Error("A task is expected to expire after ExpiresAt")
+	}
+}
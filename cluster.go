@@ -0,0 +1,222 @@
+package redisq
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// amount of Redis Cluster hash slots
+const CLUSTER_SLOTS = 16384
+
+// Connects to the Redis Cluster node serving the keys of a task type (see Daemon.Cluster)
+// All the keys of a task type share a hash tag (see RedisClient.Cluster), so one connection is enough,
+// a worker reconnects through the cluster after a failover or resharding (MOVED error)
+type Cluster struct {
+	// addresses of (some of) the cluster nodes, the unknown slot owner is asked for on every one until one replies
+	Addrs []string
+	// used to connect to the nodes
+	DialOptions *DialOptions
+	mu          sync.Mutex
+	// known master addresses by slot, learnt from CLUSTER SLOTS and MOVED errors
+	slots map[int]string
+}
+
+// escapes the braces of a task type (and the escape character itself), so that it is a valid hash tag
+var hashTagEscaper = strings.NewReplacer("%", "%25", "{", "%7B", "}", "%7D")
+
+// hash tag of the empty task type, "{}" would hash the whole key; a lone "%" is never produced by the escaper
+const emptyHashTag = "%"
+
+// hash tag shared by all the keys of the task type (in cluster mode)
+func hashTag(taskType string) string {
+	if taskType == "" {
+		return emptyHashTag
+	}
+
+	return hashTagEscaper.Replace(taskType)
+}
+
+// Instantiates Cluster class
+// In addition it is possible to set exported parameters (DialOptions)
+func NewCluster(addrs []string) *Cluster {
+	return &Cluster{Addrs: addrs}
+}
+
+// computes crc16 (XMODEM) of data, as used for the key slots
+func crc16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc ^= uint16(data[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+// slot of the keys of the task type (in cluster mode)
+func taskTypeSlot(taskType string) int {
+	return int(crc16(hashTag(taskType))) % CLUSTER_SLOTS
+}
+
+// asks a node for the address of the master serving the slot
+func querySlotOwner(conn redis.Conn, slot int) (string, error) {
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return "", err
+	}
+
+	for _, r := range ranges {
+		// start, end, master node (ip, port, ...), replica nodes
+		values, err := redis.Values(r, nil)
+		if err != nil || len(values) < 3 {
+			return "", errors.New("Unexpected reply to CLUSTER SLOTS")
+		}
+
+		start, err := redis.Int(values[0], nil)
+		if err != nil {
+			return "", err
+		}
+		end, err := redis.Int(values[1], nil)
+		if err != nil {
+			return "", err
+		}
+		if slot < start || slot > end {
+			continue
+		}
+
+		node, err := redis.Values(values[2], nil)
+		if err != nil || len(node) < 2 {
+			return "", errors.New("Unexpected reply to CLUSTER SLOTS")
+		}
+
+		host, err := redis.String(node[0], nil)
+		if err != nil {
+			return "", err
+		}
+		port, err := redis.Int(node[1], nil)
+		if err != nil {
+			return "", err
+		}
+
+		return net.JoinHostPort(host, strconv.Itoa(port)), nil
+	}
+
+	return "", fmt.Errorf("Slot %d is not served by the cluster", slot)
+}
+
+func (c *Cluster) slotAddr(slot int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.slots[slot]
+}
+
+// remembers the master serving the slot, forgets it if addr is empty
+func (c *Cluster) setSlotAddr(slot int, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.slots == nil {
+		c.slots = map[int]string{}
+	}
+
+	if addr == "" {
+		delete(c.slots, slot)
+	} else {
+		c.slots[slot] = addr
+	}
+}
+
+// learns the new master of a slot from a "MOVED <slot> <addr>" error
+func (c *Cluster) redirected(err error) {
+	e, ok := err.(redis.Error)
+	if !ok {
+		return
+	}
+
+	fields := strings.Fields(string(e))
+	if len(fields) != 3 || fields[0] != "MOVED" {
+		return
+	}
+
+	if slot, err := strconv.Atoi(fields[1]); err == nil {
+		c.setSlotAddr(slot, fields[2])
+	}
+}
+
+// discovers the address of the master serving the keys of the task type,
+// the cluster is asked only if it is not known yet
+func (c *Cluster) MasterAddr(taskType string) (string, error) {
+	slot := taskTypeSlot(taskType)
+	if addr := c.slotAddr(slot); addr != "" {
+		return addr, nil
+	}
+
+	err := errors.New("No cluster addresses")
+	for _, addr := range c.Addrs {
+		var conn redis.Conn
+		if conn, err = c.DialOptions.Dial(addr); err != nil {
+			continue
+		}
+
+		var owner string
+		owner, err = querySlotOwner(conn, slot)
+		conn.Close()
+		if err == nil {
+			c.setSlotAddr(slot, owner)
+			return owner, nil
+		}
+	}
+
+	return "", err
+}
+
+// returns a DialFunc connecting to the master serving the keys of the task type
+func (c *Cluster) Dialer(taskType string) DialFunc {
+	return func() (redis.Conn, error) {
+		addr, err := c.MasterAddr(taskType)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := c.DialOptions.Dial(addr)
+		if err != nil {
+			// the master may have failed, ask the cluster again next time
+			c.setSlotAddr(taskTypeSlot(taskType), "")
+			return nil, err
+		}
+
+		return &clusterConn{Conn: conn, cluster: c}, nil
+	}
+}
+
+// connection to a cluster node, passes the MOVED errors to the cluster
+type clusterConn struct {
+	redis.Conn
+	cluster *Cluster
+}
+
+func (c *clusterConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(commandName, args...)
+	c.cluster.redirected(err)
+
+	return reply, err
+}
+
+func (c *clusterConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	c.cluster.redirected(err)
+
+	return reply, err
+}
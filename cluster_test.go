@@ -0,0 +1,122 @@
+package redisq
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"testing"
+)
+
+func TestRedisClient_Cluster_keys(t *testing.T) {
+	client := getRedisClient(redigomock.NewConn())
+	client.Cluster = true
+
+	keys := map[string]string{
+		client.listKey(LIST_QUEUE):           "foo:queue:{dummy}",
+		client.taskKey(CLIENT_TASK_UUID):     "foo:task:{dummy}:" + CLIENT_TASK_UUID,
+		client.uniqueKey("key"):              "foo:unique:{dummy}:key",
+		client.heartbeatKey("owner"):         "foo:heartbeat:{dummy}:owner",
+		client.resultKey(CLIENT_TASK_UUID):   "foo:result:{dummy}:" + CLIENT_TASK_UUID,
+		client.notifyKey(CLIENT_TASK_UUID):   "foo:notify:{dummy}:" + CLIENT_TASK_UUID,
+		client.listKey(leaseSet(LIST_QUEUE)): "foo:queue_leases:{dummy}",
+	}
+
+	for got, expected := range keys {
+		if got != expected {
+			t.Errorf("Expected key %+v got %+v", expected, got)
+		}
+	}
+}
+
+func TestTaskTypeSlot(t *testing.T) {
+	// reference values of the Redis Cluster specification
+	if slot := taskTypeSlot("123456789"); slot != 0x31C3 {
+		t.Errorf("Expected slot %d got %d", 0x31C3, slot)
+	}
+
+	if slot := taskTypeSlot("foo"); slot != 12182 {
+		t.Errorf("Expected slot %d got %d", 12182, slot)
+	}
+}
+
+func TestQuerySlotOwner(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("CLUSTER", "SLOTS").Expect([]interface{}{
+		[]interface{}{int64(0), int64(8191), []interface{}{[]byte("10.0.0.1"), int64(7000)}},
+		[]interface{}{int64(8192), int64(16383), []interface{}{[]byte("10.0.0.2"), int64(7001)}, []interface{}{[]byte("10.0.0.3"), int64(7002)}},
+	})
+
+	addr, err := querySlotOwner(conn, 12182)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr != "10.0.0.2:7001" {
+		t.Errorf("Expected %+v got %+v", "10.0.0.2:7001", addr)
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestRedisClient_Cluster_keys_Braces(t *testing.T) {
+	client := NewRedisClient(redigomock.NewConn(), "foo", "a{b}%")
+	client.Cluster = true
+
+	if key := client.listKey(LIST_QUEUE); key != "foo:queue:{a%7Bb%7D%25}" {
+		t.Errorf("Expected key %+v got %+v", "foo:queue:{a%7Bb%7D%25}", key)
+	}
+
+	if slot := taskTypeSlot("a{b}%"); slot != int(crc16("a%7Bb%7D%25"))%CLUSTER_SLOTS {
+		t.Errorf("Expected the slot of the escaped hash tag got %d", slot)
+	}
+}
+
+func TestRedisClient_Cluster_keys_EmptyType(t *testing.T) {
+	client := NewRedisClient(redigomock.NewConn(), "foo", "")
+	client.Cluster = true
+
+	if key := client.listKey(LIST_QUEUE); key != "foo:queue:{%}" {
+		t.Errorf("Expected key %+v got %+v", "foo:queue:{%}", key)
+	}
+
+	if key := client.taskKey(CLIENT_TASK_UUID); key != "foo:task:{%}:"+CLIENT_TASK_UUID {
+		t.Errorf("Expected key %+v got %+v", "foo:task:{%}:"+CLIENT_TASK_UUID, key)
+	}
+
+	if slot := taskTypeSlot(""); slot != int(crc16("%"))%CLUSTER_SLOTS {
+		t.Errorf("Expected the slot of the placeholder hash tag got %d", slot)
+	}
+}
+
+func TestCluster_MasterAddr_Cached(t *testing.T) {
+	// unreachable node, the address must come from the cache
+	cluster := NewCluster([]string{"127.0.0.1:1"})
+	cluster.setSlotAddr(taskTypeSlot("foo"), "10.0.0.1:7000")
+
+	addr, err := cluster.MasterAddr("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr != "10.0.0.1:7000" {
+		t.Errorf("Expected %+v got %+v", "10.0.0.1:7000", addr)
+	}
+}
+
+func TestCluster_Moved(t *testing.T) {
+	cluster := NewCluster([]string{"127.0.0.1:1"})
+	cluster.setSlotAddr(12182, "10.0.0.1:7000")
+
+	conn := redigomock.NewConn()
+	conn.Command("LLEN", "foo:queue:{foo}").ExpectError(redis.Error("MOVED 12182 10.0.0.2:7001"))
+
+	_, err := (&clusterConn{Conn: conn, cluster: cluster}).Do("LLEN", "foo:queue:{foo}")
+	if err == nil {
+		t.Fatal("Expected the MOVED error")
+	}
+
+	if addr, _ := cluster.MasterAddr("foo"); addr != "10.0.0.2:7001" {
+		t.Errorf("Expected %+v got %+v", "10.0.0.2:7001", addr)
+	}
+}
@@ -0,0 +1,101 @@
+package redisq
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"sync"
+)
+
+// Encodes task details stored in redis
+// The first byte of the encoded data identifies the codec, so that tasks written
+// with any registered codec can be read regardless of the codec used for writing
+type Codec interface {
+	// the first byte of every encoded value
+	Marker() byte
+	Marshal(taskDetails *TaskDetails) ([]byte, error)
+	Unmarshal(data []byte, taskDetails *TaskDetails) error
+}
+
+// marker byte of MsgpackCodec (version 1)
+const CODEC_MSGPACK_V1 = 0x01
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[byte]Codec{}
+)
+
+func init() {
+	RegisterCodec(&JSONCodec{})
+	RegisterCodec(&MsgpackCodec{})
+}
+
+// makes data encoded with the codec readable by every RedisClient
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	codecs[codec.Marker()] = codec
+}
+
+// decodes task details with the codec they were encoded with
+func decodeTaskDetails(data []byte, taskDetails *TaskDetails) error {
+	if len(data) == 0 {
+		return fmt.Errorf("Decoding empty task details failed")
+	}
+
+	codecsMu.RLock()
+	codec, ok := codecs[data[0]]
+	codecsMu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("No codec registered for marker 0x%02x", data[0])
+	}
+
+	return codec.Unmarshal(data, taskDetails)
+}
+
+// Default codec, plain json (the opening brace is its marker)
+type JSONCodec struct{}
+
+func (c *JSONCodec) Marker() byte {
+	return '{'
+}
+
+func (c *JSONCodec) Marshal(taskDetails *TaskDetails) ([]byte, error) {
+	return json.Marshal(taskDetails)
+}
+
+func (c *JSONCodec) Unmarshal(data []byte, taskDetails *TaskDetails) error {
+	return json.Unmarshal(data, taskDetails)
+}
+
+// Compact binary codec (MessagePack, using the json field names)
+type MsgpackCodec struct{}
+
+func (c *MsgpackCodec) Marker() byte {
+	return CODEC_MSGPACK_V1
+}
+
+func (c *MsgpackCodec) Marshal(taskDetails *TaskDetails) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{CODEC_MSGPACK_V1})
+	enc := msgpack.NewEncoder(buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(taskDetails); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c *MsgpackCodec) Unmarshal(data []byte, taskDetails *TaskDetails) error {
+	if len(data) == 0 || data[0] != CODEC_MSGPACK_V1 {
+		return fmt.Errorf("Data is not encoded with MsgpackCodec")
+	}
+
+	dec := msgpack.NewDecoder(bytes.NewReader(data[1:]))
+	dec.SetCustomStructTag("json")
+
+	return dec.Decode(taskDetails)
+}
@@ -0,0 +1,71 @@
+package redisq
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rafaeljusto/redigomock"
+	"reflect"
+	"testing"
+)
+
+func TestMsgpackCodec(t *testing.T) {
+	original := getClientTaskDetails()
+	original.Payload = json.RawMessage(`{"userId":42}`)
+
+	codec := &MsgpackCodec{}
+	data, err := codec.Marshal(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data[0] != CODEC_MSGPACK_V1 {
+		t.Errorf("Expected marker 0x%02x, got 0x%02x", CODEC_MSGPACK_V1, data[0])
+	}
+
+	var decoded TaskDetails
+	if err := decodeTaskDetails(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(original, &decoded) {
+		t.Errorf("Original task details and resulting task details do not match, expected %+v, got %+v", original, decoded)
+	}
+}
+
+func TestRedisClient_GetTaskDetails_MixedCodecs(t *testing.T) {
+	original := getClientTaskDetails()
+	jsonData, err := (&JSONCodec{}).Marshal(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgpackData, err := (&MsgpackCodec{}).Marshal(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := redigomock.NewConn()
+	conn.Command("GET",
+		fmt.Sprintf("%s:%s:%s:%s", CLIENT_REDIS_PREFIX, QUEUE_TASK, CLIENT_TASK_TYPE, CLIENT_TASK_UUID),
+	).Expect(jsonData).Expect(msgpackData)
+
+	client := getRedisClient(conn)
+	client.Codec = &MsgpackCodec{}
+
+	for _, name := range []string{"json", "msgpack"} {
+		taskDetails, err := client.GetTaskDetails(CLIENT_TASK_UUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(original, taskDetails) {
+			t.Errorf("Task details written with %s codec do not match", name)
+		}
+	}
+}
+
+func TestDecodeTaskDetails_UnknownMarker(t *testing.T) {
+	var taskDetails TaskDetails
+	if err := decodeTaskDetails([]byte{0xff, 0x00}, &taskDetails); err == nil {
+		t.Error("decodeTaskDetails() is expected to fail on an unknown marker")
+	}
+}
@@ -1,94 +1,390 @@
 package redisq
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"math/rand"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Daemon struct {
-	redisPrefix          string
-	redisAddr            string
-	failureW             chan error
-	failureFW            chan error
-	taskType             string
-	workerCount          int
-	FailureMaxAttempts   int
-	FailureSleepTime     int
+	id                 string
+	redisPrefix        string
+	redisAddr          string
+	failureW           chan error
+	failureFW          chan error
+	taskType           string
+	workerCount        int
+	FailureWorkerCount int
+	FailureMaxAttempts int
+	FailureSleepTime   int
+	SchedulerInterval  int
+	PriorityStrategy   PriorityStrategy
+	WorkerPollTime     int
+	ResultTTL          int
+	HeartbeatTTL       int
+	ReaperInterval     int
+	VisibilityTimeout  int
+	HandlerTimeout     int
+	// ms, how long the cancelled handlers may take to settle their tasks once the Shutdown deadline is exceeded
+	ShutdownGraceTime    int
 	WorkerHandler        WorkerHandler
 	FailureWorkerHandler WorkerHandler
 	Logger               Logger
+	// take precedence over WorkerHandler and FailureWorkerHandler, if set (e.g. a HandlerFunc)
+	TaskHandler        TaskHandler
+	FailureTaskHandler TaskHandler
+	// delays retries of failed tasks (FixedBackoff of FailureSleepTime, if nil)
+	RetryPolicy RetryPolicy
+	// policies that can be chosen per task (see EnqueueOptions.RetryPolicy)
+	RetryPolicies map[string]RetryPolicy
+	// used to connect to redisAddr, unless Dial is set
+	DialOptions *DialOptions
+	// creates the connections, if set (e.g. PoolDialer)
+	// Connections of PoolDialer are not returned to the pool on the Shutdown deadline, only once their worker stops
+	Dial DialFunc
+	// connection attempts before a worker reports DialError and pauses before trying again (unlimited, if zero)
+	DialMaxAttempts int
+	// delays the connection attempts (ExponentialBackoff from 1s up to 15s, if nil)
+	DialRetryPolicy RetryPolicy
+	// connects to the current master, if set (and Dial is not)
+	Sentinel *Sentinel
+	// one of BACKEND_* constants, BACKEND_LISTS if empty
+	Backend string
+	// enables the cluster key layout and connects to the node serving the task type (unless Dial is set)
+	Cluster *Cluster
+	// used to encode task details (JSONCodec, if nil)
+	Codec         Codec
+	periodicTasks []*PeriodicTask
+	// parent of the handler contexts, cancelled on shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+	// closed on shutdown, see Shutdown
+	stopping chan struct{}
+	// closed once the handlers cannot touch their tasks any more (the heartbeat is kept until then)
+	drained chan struct{}
+	// guards stopping, drained, the wait groups and conns
+	mu         sync.Mutex
+	workers    sync.WaitGroup
+	background sync.WaitGroup
+	// connections of the running workers
+	conns map[redis.Conn]bool
 }
 
 func (d *Daemon) sleep(from, to int32) {
 	n := rand.Int31n(to-from) + from // [5..15)
 	d.Logger.Infof(" Sleeping %d seconds.", n)
 	runtime.Gosched()
-	time.Sleep(time.Duration(n) * time.Second)
+	d.wait(time.Duration(n) * time.Second)
 }
 
-func (d *Daemon) getRedisConn(addr string) redis.Conn {
-	for {
-		conn, err := redis.Dial("tcp", addr)
+// waits for the duration, returns false if the daemon has started stopping meanwhile
+func (d *Daemon) wait(duration time.Duration) bool {
+	return waitFor(duration, d.stopping)
+}
 
-		if err != nil {
-			d.Logger.Errorf("Cannot connect to Redis: %+v.", err)
-			d.sleep(5, 15)
-			continue
+// waits for the duration, returns false if done is closed meanwhile
+func waitFor(duration time.Duration, done <-chan struct{}) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// checks whether the daemon is stopping
+func (d *Daemon) stopped() bool {
+	select {
+	case <-d.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// creates a connection with Dial, Sentinel or Cluster, if set, or to redisAddr with DialOptions
+func (d *Daemon) dial() (redis.Conn, error) {
+	if d.Dial != nil {
+		return d.Dial()
+	}
+
+	if d.Cluster != nil {
+		return d.Cluster.Dialer(d.taskType)()
+	}
+
+	if d.Sentinel != nil {
+		return d.Sentinel.Dial()
+	}
+
+	return d.DialOptions.Dial(d.redisAddr)
+}
+
+func (d *Daemon) dialRetryPolicy() RetryPolicy {
+	if d.DialRetryPolicy != nil {
+		return d.DialRetryPolicy
+	}
+
+	return &ExponentialBackoff{Initial: time.Second, Max: 15 * time.Second, Jitter: 0.5}
+}
+
+// connects, retrying up to DialMaxAttempts times, returns DialError if all the attempts fail
+// Returns nil without an error, if the daemon has started stopping before connecting
+func (d *Daemon) getRedisConn() (redis.Conn, error) {
+	for attempts := 1; !d.stopped(); attempts++ {
+		conn, err := d.dial()
+		if err == nil {
+			return conn, nil
+		}
+
+		if d.DialMaxAttempts > 0 && attempts >= d.DialMaxAttempts {
+			return nil, &DialError{Attempts: attempts, Err: err}
 		}
 
-		return conn
+		delay := d.dialRetryPolicy().NextDelay(attempts)
+		d.Logger.Errorf("Cannot connect to Redis: %+v. Retrying in %s.", err, delay)
+		d.wait(delay)
+	}
+
+	return nil, nil
+}
+
+// reports the error through the failure channel, unless the daemon is stopping
+func (d *Daemon) report(failure chan error, err error) {
+	select {
+	case failure <- err:
+	case <-d.stopping:
+	}
+}
+
+// reports DialError and runs the worker again after the longest dial delay,
+// so that the workers survive an outage (unless the daemon is stopping)
+func (d *Daemon) redial(failure chan error, err error, run func()) {
+	d.report(failure, err)
+	if d.wait(d.dialRetryPolicy().NextDelay(d.DialMaxAttempts)) {
+		go run()
+	}
+}
+
+// runs fn in a goroutine counted by wg, unless the daemon is stopping
+func (d *Daemon) spawn(wg *sync.WaitGroup, fn func()) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stopped() {
+		return false
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fn()
+	}()
+
+	return true
+}
+
+// runs a worker on the connection, closes the connection once the worker stops
+func (d *Daemon) spawnWorker(conn redis.Conn, worker WorkerInterface) bool {
+	d.mu.Lock()
+	d.conns[conn] = true
+	d.mu.Unlock()
+
+	release := func() {
+		d.mu.Lock()
+		delete(d.conns, conn)
+		d.mu.Unlock()
+		conn.Close()
+	}
+
+	if !d.spawn(&d.workers, func() {
+		defer release()
+		worker.Run()
+	}) {
+		release()
+		return false
+	}
+
+	return true
+}
+
+func (d *Daemon) setupClient(rc *RedisClient) {
+	if d.Codec != nil {
+		rc.Codec = d.Codec
+	}
+	rc.Cluster = d.Cluster != nil
+}
+
+func (d *Daemon) newRedisClient(conn redis.Conn) *RedisClient {
+	rc := NewRedisClient(conn, d.redisPrefix, d.taskType)
+	d.setupClient(rc)
+
+	return rc
+}
+
+func (d *Daemon) retryPolicy() RetryPolicy {
+	if d.RetryPolicy != nil {
+		return d.RetryPolicy
+	}
+
+	return &FixedBackoff{Delay: time.Duration(d.FailureSleepTime) * time.Millisecond}
+}
+
+func (d *Daemon) workerHandler() TaskHandler {
+	if d.TaskHandler != nil {
+		return d.TaskHandler
+	}
+
+	return d.WorkerHandler
+}
+
+func (d *Daemon) failureWorkerHandler() TaskHandler {
+	if d.FailureTaskHandler != nil {
+		return d.FailureTaskHandler
 	}
+
+	return d.FailureWorkerHandler
 }
 
 func (d *Daemon) runWorker(id int) {
-	conn := d.getRedisConn(d.redisAddr)
-	worker := NewWorker(
+	conn, err := d.getRedisConn()
+	if err != nil {
+		d.redial(d.failureW, err, func() { d.runWorker(id) })
+		return
+	}
+	if conn == nil {
+		return
+	}
+
+	rc := d.newRedisClient(conn)
+	worker := NewBackendWorker(
 		id,
-		conn,
-		d.redisPrefix,
-		d.taskType,
-		d.WorkerHandler,
+		rc,
+		d.workerHandler(),
 		d.failureW,
 	)
 	worker.Logger = WrapLogger(d.Logger, fmt.Sprintf("[%s][%s][%d] ", "w", d.taskType, id))
-	go func(conn redis.Conn) {
-		defer conn.Close()
-		worker.Run()
-	}(conn)
+	worker.PriorityStrategy = d.PriorityStrategy
+	worker.PollTime = d.WorkerPollTime
+	worker.ResultTTL = d.ResultTTL
+	worker.OwnerId = d.id
+	worker.VisibilityTimeout = d.VisibilityTimeout
+	worker.MaxAttempts = d.FailureMaxAttempts
+	// promoted by the scheduler
+	worker.PromoteInterval = 0
+	worker.RetryPolicy = d.retryPolicy()
+	worker.RetryPolicies = d.RetryPolicies
+	worker.HandlerTimeout = d.HandlerTimeout
+	worker.ctx = d.ctx
+	worker.stop = d.stopping
+
+	if d.Backend == BACKEND_STREAMS {
+		streamWorker := newStreamWorker(worker, rc, d.id)
+		streamWorker.ClaimIdle = int(d.claimIdle() / time.Millisecond)
+		d.spawnWorker(conn, streamWorker)
+		return
+	}
+
+	d.spawnWorker(conn, worker)
 }
 
 func (d *Daemon) runFailureWorker(id int) WorkerInterface {
-	conn := d.getRedisConn(d.redisAddr)
-	failureWorker := NewFailureWorker(
+	conn, err := d.getRedisConn()
+	if err != nil {
+		d.redial(d.failureFW, err, func() { d.runFailureWorker(id) })
+		return nil
+	}
+	if conn == nil {
+		return nil
+	}
+
+	failureWorker := NewBackendFailureWorker(
 		id,
-		conn,
-		d.redisPrefix,
-		d.taskType,
-		d.FailureWorkerHandler,
+		d.newRedisClient(conn),
+		d.failureWorkerHandler(),
 		d.failureFW,
 	)
 	failureWorker.MaxAttempts = d.FailureMaxAttempts
-	failureWorker.SleepTime = d.FailureSleepTime
+	failureWorker.PromoteInterval = 0
+	failureWorker.RetryPolicy = d.retryPolicy()
+	failureWorker.RetryPolicies = d.RetryPolicies
+	failureWorker.ResultTTL = d.ResultTTL
+	failureWorker.OwnerId = d.id
+	failureWorker.VisibilityTimeout = d.VisibilityTimeout
+	failureWorker.HandlerTimeout = d.HandlerTimeout
+	failureWorker.ctx = d.ctx
+	failureWorker.stop = d.stopping
 	failureWorker.Logger = WrapLogger(d.Logger, fmt.Sprintf("[%s][%s][%d] ", "f", d.taskType, id))
-	go func(conn redis.Conn) {
-		defer conn.Close()
-		failureWorker.Run()
-	}(conn)
+	d.spawnWorker(conn, failureWorker)
 
 	return failureWorker
 }
 
+// moves scheduled tasks to the queue once they are due
+func (d *Daemon) runScheduler() {
+	logger := WrapLogger(d.Logger, fmt.Sprintf("[%s][%s] ", "s", d.taskType))
+	logger.Debug("started")
+	for {
+		conn, err := d.getRedisConn()
+		if conn == nil && err == nil {
+			return
+		}
+
+		if err == nil {
+			err = d.promoteScheduledTasks(d.newRedisClient(conn), logger)
+			conn.Close()
+		}
+
+		if err == nil {
+			logger.Debug("stopped")
+			return
+		}
+
+		logger.Errorf("Scheduler failed with error: %+v", err)
+		d.sleep(5, 15)
+	}
+}
+
+// returns nil once the daemon is stopping
+func (d *Daemon) promoteScheduledTasks(rc *RedisClient, logger Logger) error {
+	promote, to := rc.PromoteScheduledTasks, LIST_QUEUE
+	if d.Backend == BACKEND_STREAMS {
+		promote, to = rc.PromoteScheduledStreamTasks, STREAM_TASKS
+	}
+
+	for {
+		n, err := promote(time.Now(), DEFAULT_PROMOTE_BATCH_SIZE)
+		if err != nil {
+			return err
+		}
+
+		if n > 0 {
+			logger.Debugf("Moved %d scheduled tasks to %s", n, to)
+		}
+
+		// there may be more due tasks, do not wait
+		if n < DEFAULT_PROMOTE_BATCH_SIZE && !d.wait(time.Duration(d.SchedulerInterval)*time.Millisecond) {
+			return nil
+		}
+	}
+}
+
 func (d *Daemon) workerErrorHandler() {
 	for {
 		select {
+		case <-d.stopping:
+			return
 		case err := <-d.failureW:
 			if val, ok := err.(WorkerFatalError); ok {
-				d.Logger.Errorf("[%s][%s] failed with error: %+v", val.Worker.GetInstanceId(), val.Worker.GetTaskType(), val.Err)
+				d.Logger.Errorf("[%d][%s] failed with error: %+v", val.Worker.GetInstanceId(), val.Worker.GetTaskType(), val.Err)
 				go func() {
 					d.sleep(5, 15)
 					d.runWorker(val.Worker.GetInstanceId())
@@ -98,7 +394,7 @@ func (d *Daemon) workerErrorHandler() {
 			}
 		case err := <-d.failureFW:
 			if val, ok := err.(WorkerFatalError); ok {
-				d.Logger.Errorf("[%s][%s] failed with error: %+v", val.Worker.GetInstanceId(), val.Worker.GetTaskType(), val.Err)
+				d.Logger.Errorf("[%d][%s] failed with error: %+v", val.Worker.GetInstanceId(), val.Worker.GetTaskType(), val.Err)
 				go func() {
 					d.sleep(5, 15)
 					d.runFailureWorker(val.Worker.GetInstanceId())
@@ -110,17 +406,100 @@ func (d *Daemon) workerErrorHandler() {
 	}
 }
 
-// use this method to start the workers
+// use this method to start the workers (see Shutdown to stop them)
 func (d *Daemon) Run() {
+	// follow the failovers before the workers connect
+	if d.Sentinel != nil && d.Dial == nil {
+		if _, ok := d.Sentinel.Logger.(*NullLogger); ok || d.Sentinel.Logger == nil {
+			d.Sentinel.Logger = WrapLogger(d.Logger, fmt.Sprintf("[%s][%s] ", "sentinel", d.taskType))
+		}
+		d.spawn(&d.background, d.runSentinel)
+	}
+
 	// initial start
 	for i := 0; i < d.workerCount; i++ {
 		go d.runWorker(i)
 	}
 
-	go d.runFailureWorker(0)
+	// workers retry failed tasks on their own, failure workers only finalize them
+	for i := 0; i < d.FailureWorkerCount; i++ {
+		go d.runFailureWorker(i)
+	}
+
+	d.spawn(&d.background, d.runScheduler)
+
+	// recover tasks of crashed daemons
+	d.spawn(&d.background, d.runHeartbeat)
+	d.spawn(&d.background, d.runReaper)
+
+	if len(d.periodicTasks) > 0 {
+		d.spawn(&d.background, d.runPeriodic)
+	}
 
 	// restart workers on failure
-	go d.workerErrorHandler()
+	d.spawn(&d.background, d.workerErrorHandler)
+}
+
+// lets the heartbeat stop, the daemon tasks are either finished or requeued
+func (d *Daemon) drain() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	select {
+	case <-d.drained:
+	default:
+		close(d.drained)
+	}
+}
+
+// Stops picking new tasks and waits for the tasks being processed until ctx is done,
+// then cancels their handlers and gives them ShutdownGraceTime to settle their tasks,
+// closes the connections of the workers still running and requeues their tasks
+// A handler ignoring the cancellation may still be running (and have side effects) after that,
+// so its task may be run twice
+// Returns the ctx error, if the tasks have not finished in time
+func (d *Daemon) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.stopped() {
+		close(d.stopping)
+	}
+	d.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		d.workers.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		d.drain()
+		d.cancel()
+		d.background.Wait()
+		return nil
+	case <-ctx.Done():
+	}
+
+	// the interrupted handlers return their tasks to the queues on their own
+	d.cancel()
+	waitFor(time.Duration(d.ShutdownGraceTime)*time.Millisecond, finished)
+
+	// the workers still running cannot touch their tasks any more
+	d.mu.Lock()
+	for conn := range d.conns {
+		interrupt(conn)
+	}
+	d.mu.Unlock()
+
+	n, err := d.requeueOwnedTasks()
+	if err != nil {
+		d.Logger.Errorf("Requeueing unfinished tasks failed: %+v", err)
+	}
+
+	d.drain()
+	d.background.Wait()
+
+	return fmt.Errorf("Shutdown deadline exceeded, %d unfinished tasks requeued: %w", n, ctx.Err())
 }
 
 // this is the only way how you should init the daemon (no direct instantiation)
@@ -139,17 +518,36 @@ func NewDaemon(taskType string, workerCount int, redisPrefix, redisAddr string)
 		return errors.New("Failure worker is not supported at the moment")
 	})
 
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &Daemon{
+		id:                   newOwnerId(),
 		redisPrefix:          redisPrefix,
 		redisAddr:            redisAddr,
 		failureW:             make(chan error, 0),
 		failureFW:            make(chan error, 0),
 		taskType:             taskType,
 		workerCount:          workerCount,
+		FailureWorkerCount:   1,
 		FailureMaxAttempts:   2,
 		FailureSleepTime:     10000,
+		SchedulerInterval:    1000,
+		PriorityStrategy:     &StrictPriority{},
+		WorkerPollTime:       1000,
+		ResultTTL:            int(DEFAULT_RESULT_TTL / time.Millisecond),
+		HeartbeatTTL:         int(DEFAULT_HEARTBEAT_TTL / time.Millisecond),
+		ReaperInterval:       10000,
+		VisibilityTimeout:    300000,
+		ShutdownGraceTime:    2000,
+		DialMaxAttempts:      10,
+		RetryPolicies:        map[string]RetryPolicy{},
 		WorkerHandler:        workerHandler,
 		FailureWorkerHandler: failureWorkerHandler,
 		Logger:               logger,
+		ctx:                  ctx,
+		cancel:               cancel,
+		stopping:             make(chan struct{}),
+		drained:              make(chan struct{}),
+		conns:                map[redis.Conn]bool{},
 	}
 }
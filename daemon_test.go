@@ -0,0 +1,234 @@
+package redisq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDaemon_Shutdown(t *testing.T) {
+	d := NewDaemon(CLIENT_TASK_TYPE, 1, CLIENT_REDIS_PREFIX, "")
+
+	// a worker finishing its task once asked to stop
+	d.spawn(&d.workers, func() {
+		<-d.stopping
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := d.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.spawn(&d.workers, func() {}) {
+		t.Error("No workers are expected to start after shutdown")
+	}
+}
+
+func TestDaemon_Shutdown_Deadline(t *testing.T) {
+	d := NewDaemon(CLIENT_TASK_TYPE, 1, CLIENT_REDIS_PREFIX, "")
+
+	// a handler that runs until it is cancelled
+	d.spawn(&d.workers, func() {
+		<-d.ctx.Done()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := d.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded error, got %+v", err)
+	}
+
+	if d.ctx.Err() != context.Canceled {
+		t.Error("Handlers are expected to be cancelled")
+	}
+}
+
+// counts the commands run on the mocked connection
+type countingConn struct {
+	*redigomock.Conn
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newCountingConn(conn *redigomock.Conn) *countingConn {
+	return &countingConn{Conn: conn, counts: map[string]int{}}
+}
+
+func (c *countingConn) Do(command string, args ...interface{}) (interface{}, error) {
+	c.mu.Lock()
+	c.counts[command]++
+	c.mu.Unlock()
+
+	return c.Conn.Do(command, args...)
+}
+
+func (c *countingConn) count(command string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.counts[command]
+}
+
+// runs fn as a worker on the connection, as spawnWorker does
+func spawnTestWorker(d *Daemon, conn redis.Conn, fn func()) {
+	d.mu.Lock()
+	d.conns[conn] = true
+	d.mu.Unlock()
+
+	d.spawn(&d.workers, func() {
+		fn()
+		d.mu.Lock()
+		delete(d.conns, conn)
+		d.mu.Unlock()
+	})
+}
+
+func TestDaemon_Shutdown_KeepsHeartbeat(t *testing.T) {
+	mock := redigomock.NewConn()
+	mock.GenericCommand("SET").Expect("OK")
+	clear := mock.GenericCommand("DEL").Expect(int64(1))
+	conn := newCountingConn(mock)
+
+	d := NewDaemon(CLIENT_TASK_TYPE, 1, CLIENT_REDIS_PREFIX, "")
+	d.HeartbeatTTL = 30
+	d.Dial = func() (redis.Conn, error) {
+		return conn, nil
+	}
+	d.spawn(&d.background, d.runHeartbeat)
+
+	// a worker still processing its task after it has been asked to stop
+	release := make(chan struct{})
+	d.spawn(&d.workers, func() {
+		<-release
+	})
+
+	done := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- d.Shutdown(ctx)
+	}()
+
+	<-d.stopping
+	time.Sleep(50 * time.Millisecond)
+	beats := conn.count("SET")
+	time.Sleep(50 * time.Millisecond)
+	if conn.count("SET") <= beats {
+		t.Error("Heartbeat is expected to be kept while the worker is processing its task")
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if mock.Stats(clear) != 1 {
+		t.Error("Heartbeat is expected to be cleared once the worker has finished")
+	}
+}
+
+func TestDaemon_Shutdown_Deadline_Settle(t *testing.T) {
+	requeue := redigomock.NewConn()
+	requeue.GenericCommand("LRANGE").Expect([]interface{}{})
+
+	d := NewDaemon(CLIENT_TASK_TYPE, 1, CLIENT_REDIS_PREFIX, "")
+	d.Dial = func() (redis.Conn, error) {
+		return requeue, nil
+	}
+
+	var closed int32
+	conn := redigomock.NewConn()
+	conn.CloseMock = func() error {
+		atomic.StoreInt32(&closed, 1)
+		return nil
+	}
+
+	// a handler returning its task to the queue once cancelled
+	settled := make(chan bool, 1)
+	spawnTestWorker(d, conn, func() {
+		<-d.ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		settled <- atomic.LoadInt32(&closed) == 0
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := d.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded error, got %+v", err)
+	}
+
+	if !<-settled {
+		t.Error("Connection is not expected to be closed before the cancelled handler settles its task")
+	}
+}
+
+func TestDaemon_Shutdown_Deadline_Requeue(t *testing.T) {
+	jsonTaskDetails, err := json.Marshal(getClientTaskDetails())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDaemon(CLIENT_TASK_TYPE, 1, CLIENT_REDIS_PREFIX, "")
+	d.ShutdownGraceTime = 10
+
+	mock := redigomock.NewConn()
+	mock.Command("LRANGE", fmt.Sprintf("%s:%s:%s", CLIENT_REDIS_PREFIX, LIST_PROCESSING, CLIENT_TASK_TYPE), 0, -1).
+		Expect([]interface{}{[]byte(CLIENT_TASK_UUID)})
+	mock.Command("LRANGE", fmt.Sprintf("%s:%s:%s", CLIENT_REDIS_PREFIX, LIST_FAILURE_PROCESSING, CLIENT_TASK_TYPE), 0, -1).
+		Expect([]interface{}{})
+	mock.Command("HGET", fmt.Sprintf("%s:%s:%s", CLIENT_REDIS_PREFIX, HASH_OWNERS, CLIENT_TASK_TYPE), CLIENT_TASK_UUID).
+		Expect([]byte(d.id))
+	mock.Command("GET", fmt.Sprintf("%s:%s:%s:%s", CLIENT_REDIS_PREFIX, QUEUE_TASK, CLIENT_TASK_TYPE, CLIENT_TASK_UUID)).
+		Expect(jsonTaskDetails)
+	moved := mock.GenericCommand("EVALSHA").Expect(int64(1))
+	d.Dial = func() (redis.Conn, error) {
+		return mock, nil
+	}
+
+	var closed int32
+	conn := redigomock.NewConn()
+	conn.CloseMock = func() error {
+		atomic.StoreInt32(&closed, 1)
+		return nil
+	}
+
+	// a handler ignoring the cancellation
+	release := make(chan struct{})
+	defer close(release)
+	spawnTestWorker(d, conn, func() {
+		<-release
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err = d.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "1 unfinished tasks requeued") {
+		t.Fatalf("Expected the unfinished task to be requeued, got %+v", err)
+	}
+
+	if atomic.LoadInt32(&closed) != 1 {
+		t.Error("Connection of the lingering worker is expected to be closed")
+	}
+
+	if mock.Stats(moved) != 1 {
+		t.Error("Unfinished task is expected to be requeued")
+	}
+
+	if len(mock.Errors) > 0 {
+		t.Fatal(mock.Errors)
+	}
+}
@@ -0,0 +1,182 @@
+package redisq
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Creates a connection to Redis (see Daemon.Dial)
+type DialFunc func() (redis.Conn, error)
+
+// Options used to connect to Redis (see Daemon.DialOptions)
+type DialOptions struct {
+	// "tcp" (if empty) or "unix", the address is a socket path for the latter
+	Network string
+	// ACL user, the password is checked against the default user if empty
+	Username string
+	// sent with AUTH, if not empty
+	Password string
+	// selected after connecting, if not zero
+	Database int
+	// the connection is encrypted if set, client certificates are taken from its Certificates
+	TLSConfig *tls.Config
+	// zero means no timeout, ReadTimeout must exceed DEFAULT_PICK_TIMEOUT
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	// period of TCP keep-alive probes (5 minutes, if zero)
+	KeepAlive time.Duration
+	// replaces net.Dial, if set (e.g. to connect through a proxy)
+	NetDial func(network, addr string) (net.Conn, error)
+}
+
+// connects to Redis at the address, then authenticates and selects the database
+func (o *DialOptions) Dial(addr string) (redis.Conn, error) {
+	if o == nil {
+		o = &DialOptions{}
+	}
+
+	network := o.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(o.ConnectTimeout),
+		redis.DialReadTimeout(o.ReadTimeout),
+		redis.DialWriteTimeout(o.WriteTimeout),
+	}
+
+	if o.KeepAlive > 0 {
+		options = append(options, redis.DialKeepAlive(o.KeepAlive))
+	}
+
+	if o.TLSConfig != nil {
+		options = append(options, redis.DialUseTLS(true), redis.DialTLSConfig(o.TLSConfig))
+	}
+
+	if o.NetDial != nil {
+		options = append(options, redis.DialNetDial(o.NetDial))
+	}
+
+	conn, err := redis.Dial(network, addr, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := o.setup(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// authenticates (supporting ACL users) and selects the database
+func (o *DialOptions) setup(conn redis.Conn) error {
+	if o.Password != "" {
+		args := []interface{}{o.Password}
+		if o.Username != "" {
+			args = []interface{}{o.Username, o.Password}
+		}
+
+		if _, err := conn.Do("AUTH", args...); err != nil {
+			return err
+		}
+	}
+
+	if o.Database != 0 {
+		if _, err := conn.Do("SELECT", o.Database); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// creates a pool of connections dialed with the options, idle connections are checked before use
+func (o *DialOptions) NewPool(addr string, maxIdle, maxActive int) *redis.Pool {
+	return &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return o.Dial(addr)
+		},
+		TestOnBorrow: func(conn redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+
+			_, err := conn.Do("PING")
+			return err
+		},
+		MaxIdle:     maxIdle,
+		MaxActive:   maxActive,
+		IdleTimeout: 5 * time.Minute,
+	}
+}
+
+// returns a DialFunc taking connections from the pool
+// (every worker keeps its connection while running, so the pool must allow enough active connections)
+func PoolDialer(pool *redis.Pool) DialFunc {
+	return func() (redis.Conn, error) {
+		conn := pool.Get()
+		if err := conn.Err(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return &pooledConn{Conn: conn}, nil
+	}
+}
+
+// Returned by the commands of a connection interrupted on shutdown
+var errConnInterrupted = errors.New("Connection has been interrupted on shutdown")
+
+// Connection taken from a pool, it can be interrupted while in use without being returned to the pool
+// (the pool could hand it out to someone else while a blocking command is still running)
+type pooledConn struct {
+	redis.Conn
+	interrupted int32
+}
+
+// refuses the further commands, the connection is returned to the pool once closed by its user
+func (c *pooledConn) interrupt() {
+	atomic.StoreInt32(&c.interrupted, 1)
+}
+
+func (c *pooledConn) Err() error {
+	if atomic.LoadInt32(&c.interrupted) == 1 {
+		return errConnInterrupted
+	}
+
+	return c.Conn.Err()
+}
+
+func (c *pooledConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+
+	return c.Conn.Do(commandName, args...)
+}
+
+func (c *pooledConn) Send(commandName string, args ...interface{}) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	return c.Conn.Send(commandName, args...)
+}
+
+// stops the user of a connection, closes it unless it can be interrupted
+func interrupt(conn redis.Conn) {
+	if c, ok := conn.(interface{ interrupt() }); ok {
+		c.interrupt()
+		return
+	}
+
+	conn.Close()
+}
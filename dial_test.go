@@ -0,0 +1,175 @@
+package redisq
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// accepts a single connection, replies +OK to every command and reports the commands received
+func serveFakeRedis(t *testing.T) (string, chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	commands := make(chan []string, 10)
+	go func() {
+		defer listener.Close()
+		defer close(commands)
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			command := make([]string, n)
+			for i := range command {
+				r.ReadString('\n')
+				arg, _ := r.ReadString('\n')
+				command[i] = strings.TrimSpace(arg)
+			}
+
+			commands <- command
+			fmt.Fprint(conn, "+OK\r\n")
+		}
+	}()
+
+	return listener.Addr().String(), commands
+}
+
+func TestDialOptions_Dial(t *testing.T) {
+	addr, commands := serveFakeRedis(t)
+
+	options := &DialOptions{Username: "worker", Password: "secret", Database: 2}
+	conn, err := options.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	expected := [][]string{{"AUTH", "worker", "secret"}, {"SELECT", "2"}}
+	for _, command := range expected {
+		if got := <-commands; !reflect.DeepEqual(got, command) {
+			t.Errorf("Expected command %+v, got %+v", command, got)
+		}
+	}
+}
+
+func TestPoolDialer(t *testing.T) {
+	addr, commands := serveFakeRedis(t)
+
+	options := &DialOptions{Password: "secret"}
+	dial := PoolDialer(options.NewPool(addr, 1, 1))
+
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if got := <-commands; !reflect.DeepEqual(got, []string{"AUTH", "secret"}) {
+		t.Errorf("Unexpected command %+v", got)
+	}
+}
+
+func TestPoolDialer_Interrupt(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("PING").Expect("PONG")
+
+	var closed int32
+	conn.CloseMock = func() error {
+		atomic.AddInt32(&closed, 1)
+		return nil
+	}
+
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) {
+		return conn, nil
+	}}
+
+	pooled, err := PoolDialer(pool)()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	interrupt(pooled)
+	if _, err := pooled.Do("PING"); err != errConnInterrupted {
+		t.Errorf("Expected %+v, got %+v", errConnInterrupted, err)
+	}
+
+	if atomic.LoadInt32(&closed) != 0 {
+		t.Error("Interrupted connection is not expected to be closed while in use")
+	}
+
+	pooled.Close()
+	if pool.ActiveCount() != 0 {
+		t.Error("Connection is expected to be released once closed by its user")
+	}
+}
+
+func TestDaemon_getRedisConn_MaxAttempts(t *testing.T) {
+	refused := errors.New("connection refused")
+
+	d := NewDaemon(CLIENT_TASK_TYPE, 1, CLIENT_REDIS_PREFIX, "")
+	d.DialMaxAttempts = 3
+	d.DialRetryPolicy = &FixedBackoff{Delay: time.Millisecond}
+	attempts := 0
+	d.Dial = func() (redis.Conn, error) {
+		attempts++
+		return nil, refused
+	}
+
+	_, err := d.getRedisConn()
+	var dialError *DialError
+	if !errors.As(err, &dialError) || dialError.Attempts != 3 || !errors.Is(err, refused) {
+		t.Fatalf("Expected DialError after 3 attempts, got %+v", err)
+	}
+
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestDaemon_runWorker_Redial(t *testing.T) {
+	d := NewDaemon(CLIENT_TASK_TYPE, 1, CLIENT_REDIS_PREFIX, "")
+	d.DialMaxAttempts = 2
+	d.DialRetryPolicy = &FixedBackoff{Delay: time.Millisecond}
+	d.Dial = func() (redis.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	defer d.Shutdown(context.Background())
+
+	go d.runWorker(0)
+
+	// the worker keeps trying to connect after reporting DialError
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-d.failureW:
+			var dialError *DialError
+			if !errors.As(err, &dialError) {
+				t.Fatalf("Expected DialError, got %+v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Worker is expected to try connecting again after DialError")
+		}
+	}
+}
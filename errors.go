@@ -1,6 +1,20 @@
 package redisq
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Returned on enqueue when a task with the same unique key is pending or processing
+var ErrDuplicateTask = errors.New("Task with the same unique key is already pending")
+
+// Returned when a task cannot be finished, because it has left the processing list meanwhile
+// (e.g. it has been requeued by the reaper after its lease had lapsed)
+var ErrTaskLost = errors.New("Task is not in the processing list anymore")
+
+// Wrapped by the error of a ContextTaskHandler that has not finished before its deadline
+var ErrHandlerTimeout = errors.New("Handler timed out")
 
 type WorkerError struct {
 	Worker WorkerInterface
@@ -8,7 +22,22 @@ type WorkerError struct {
 }
 
 func (w WorkerError) Error() string {
-	return fmt.Sprintf("Worker Id \"%s\" failed with error \"%+v\"", w.Worker.GetInstanceId(), w.Err)
+	return fmt.Sprintf("Worker Id \"%d\" failed with error \"%+v\"", w.Worker.GetInstanceId(), w.Err)
+}
+
+// Reported through the failure channel when a worker cannot connect to Redis in Daemon.DialMaxAttempts attempts
+// (the worker tries again after a pause)
+type DialError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("Cannot connect to Redis in %d attempts: %+v", e.Attempts, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
 }
 
 type WorkerFatalError struct {
@@ -16,5 +45,69 @@ type WorkerFatalError struct {
 }
 
 func (w WorkerFatalError) Error() string {
-	return fmt.Sprintf("Worker Id \"%s\" failed with error \"%+v\"", w.Worker.GetInstanceId(), w.Err)
+	return fmt.Sprintf("Worker Id \"%d\" failed with error \"%+v\"", w.Worker.GetInstanceId(), w.Err)
+}
+
+// Handler error that must not be retried (e.g. invalid arguments),
+// the task is moved to the final failure list at once
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// wraps a handler error, so that the task is not retried
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &PermanentError{Err: err}
+}
+
+// checks whether the task must not be retried after the error
+func isPermanent(err error) bool {
+	var permanent *PermanentError
+
+	return errors.As(err, &permanent)
+}
+
+// Handler error asking to retry the task after the delay (e.g. when rate limited),
+// it overrides the retry policy delay
+type RetryAfterError struct {
+	Err   error
+	Delay time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%s (retry after %s)", e.Err.Error(), e.Delay)
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// wraps a handler error, so that the task is retried after the delay
+func RetryAfter(err error, delay time.Duration) error {
+	if err == nil {
+		return nil
+	}
+
+	return &RetryAfterError{Err: err, Delay: delay}
+}
+
+// Recovered panic of a task handler, the task is failed with it as with any other handler error
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Handler panicked: %+v\n%s", e.Value, e.Stack)
 }
@@ -0,0 +1,107 @@
+package redisq
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPermanent(t *testing.T) {
+	cause := errors.New("invalid arguments")
+	err := Permanent(cause)
+
+	var permanent *PermanentError
+	if !errors.As(err, &permanent) {
+		t.Fatal("Expected a permanent error")
+	}
+
+	if !errors.Is(err, cause) {
+		t.Error("Permanent error is expected to wrap its cause")
+	}
+
+	if Permanent(nil) != nil {
+		t.Error("Expected no error for a nil cause")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	cause := errors.New("rate limited")
+	err := RetryAfter(cause, time.Minute)
+
+	var retryAfter *RetryAfterError
+	if !errors.As(err, &retryAfter) {
+		t.Fatal("Expected a retry after error")
+	}
+
+	if retryAfter.Delay != time.Minute {
+		t.Errorf("Expected %s delay, got %s", time.Minute, retryAfter.Delay)
+	}
+
+	if !errors.Is(err, cause) {
+		t.Error("Retry after error is expected to wrap its cause")
+	}
+}
+
+func TestWorker_processTask_Permanent(t *testing.T) {
+	failure := make(chan error, 0)
+	conn := getRedisConnMock(t)
+
+	cause := errors.New("invalid arguments")
+	handler := WorkerHandler(func(logger Logger, args []string) error {
+		return Permanent(cause)
+	})
+
+	taskDetails := getWorkerTaskDetails()
+	taskDetails.NewAttempt()
+	taskDetails.LastError = cause.Error()
+	details, err := json.Marshal(taskDetails)
+	if err != nil {
+		t.Fatal(err)
+	}
+	final := expectFinishTask(conn, LIST_PROCESSING, LIST_FAILURE_FINAL, details, nil, "")
+
+	w := NewWorker(1, conn, WORKER_REDIS_PREFIX, WORKER_TASK_TYPE, handler, failure)
+	w.RetryPolicy = &FixedBackoff{Delay: time.Hour}
+	w.processTask(WORKER_TASK_UUID)
+
+	if conn.Stats(final) != 1 {
+		t.Error("Task failed permanently is expected to be moved to the final failure list")
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestWorker_processTask_Panic(t *testing.T) {
+	failure := make(chan error, 0)
+	conn := getRedisConnMock(t)
+	fail := conn.GenericCommand("EVALSHA")
+
+	handler := WorkerHandler(func(logger Logger, args []string) error {
+		panic("boom")
+	})
+
+	w := NewWorker(1, conn, WORKER_REDIS_PREFIX, WORKER_TASK_TYPE, handler, failure)
+	w.processTask(WORKER_TASK_UUID)
+
+	if conn.Stats(fail) != 1 {
+		t.Error("Panicked task is expected to be moved to the failure list")
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+
+	_, err := w.callHandler(getWorkerTaskDetails())
+
+	var panicked *PanicError
+	if !errors.As(err, &panicked) {
+		t.Fatalf("Expected a panic error, got %+v", err)
+	}
+
+	if panicked.Value != "boom" || len(panicked.Stack) == 0 {
+		t.Errorf("Unexpected panic error %+v", panicked)
+	}
+}
@@ -1,101 +1,88 @@
 package redisq
 
 import (
+	"context"
 	"time"
 
-	"fmt"
 	"github.com/garyburd/redigo/redis"
 )
 
 type FailureWorker struct {
 	Worker
-	MaxAttempts int
-	SleepTime   int
+	// ms, retries are delayed by this time unless RetryPolicy is set (returned to the queue at once, if zero)
+	SleepTime int
 }
 
 // Instantiates FailureWorker class
-// In addition it is possible to set exported parameters (Logger, MaxAttempts, SleepTime)
+// In addition it is possible to set exported parameters (Logger, MaxAttempts, SleepTime, ResultTTL, PromoteInterval, RetryPolicy, RetryPolicies)
 func NewFailureWorker(id int, conn redis.Conn, prefix, taskType string, handler WorkerHandler, failure chan error) (w *FailureWorker) {
-	w = &FailureWorker{}
+	return NewTaskFailureWorker(id, conn, prefix, taskType, taskHandler(handler), failure)
+}
+
+// Instantiates FailureWorker class with any TaskHandler (e.g. HandlerFunc), see NewFailureWorker
+func NewTaskFailureWorker(id int, conn redis.Conn, prefix, taskType string, handler TaskHandler, failure chan error) (w *FailureWorker) {
+	return NewBackendFailureWorker(id, NewRedisClient(conn, prefix, taskType), handler, failure)
+}
 
-	w.rc = NewRedisClient(
-		conn,
-		prefix,
-		taskType,
-	)
+// Instantiates FailureWorker class processing the tasks of the backend (e.g. MemoryBackend)
+func NewBackendFailureWorker(id int, backend Backend, handler TaskHandler, failure chan error) (w *FailureWorker) {
+	w = &FailureWorker{}
 
+	w.backend = backend
 	w.id = id
+	w.processing = LIST_FAILURE_PROCESSING
 	w.handler = handler
-	w.MaxAttempts = 5
+	w.MaxAttempts = DEFAULT_MAX_ATTEMPTS
 	w.SleepTime = 10 //ms
+	w.PromoteInterval = int(DEFAULT_PICK_TIMEOUT / time.Millisecond)
+	w.ResultTTL = int(DEFAULT_RESULT_TTL / time.Millisecond)
 	w.failure = failure
 	w.Logger = &NullLogger{}
+	w.ctx = context.Background()
 
 	return w
 }
 
-func (w *FailureWorker) markTaskAsFailed(uuid string, err error, taskDetails *TaskDetails, permanently bool) error {
-	var list = LIST_FAILURE
-
-	if permanently {
-		list = LIST_FAILURE_FINAL
-	}
-
-	if taskDetails != nil {
-		taskDetails.LastError = fmt.Sprintf("%+v", err)
-		w.rc.SaveTaskDetails(uuid, taskDetails)
-	}
-
-	w.Logger.Debugf("Pushing %s to %s", uuid, list)
-	if err := w.rc.PushTaskToList(uuid, list); err != nil {
-		w.Logger.Errorf("PushTaskToList(\"%s\", \"%s\") call failed: %+v", uuid, list, err)
-		return err
-	}
-
-	return nil
-}
-
 func (w *FailureWorker) processTask(uuid string) {
 	w.Logger.Debugf("Processing previously failed task id: %s", uuid)
 
-	// remove from the processing list on task finish
-	defer func() {
-		w.Logger.Debugf("Removing %s from %s", uuid, LIST_FAILURE_PROCESSING)
-		if err := w.rc.RemoveOneFromList(uuid, LIST_FAILURE_PROCESSING); err != nil {
-			w.Logger.Errorf("RemoveOneFromList(\"%s\", \"%s\") call failed: %+v", uuid, LIST_FAILURE_PROCESSING, err)
-		}
-	}()
-
-	// sleep so that we don't process this task immediately
-	w.Logger.Debugf("Sleeping %dms", w.SleepTime)
-	time.Sleep(time.Duration(w.SleepTime) * time.Millisecond)
-
 	// obtain task details
 	w.Logger.Debugf("Getting %s details", uuid)
-	taskDetails, err := w.rc.GetTaskDetails(uuid)
+	taskDetails, err := w.backend.GetTaskDetails(uuid)
 	if err != nil {
 		w.markTaskAsFailed(uuid, err, nil, true)
 		return
 	}
 
+	// neither retry nor handle a task that is worthless already
+	if taskDetails.IsExpired(time.Now()) {
+		w.markTaskAsExpired(uuid, taskDetails)
+		return
+	}
+
 	// return the task back to the queue, if it yet has attempts to try
 	if taskDetails.Attempts < w.MaxAttempts {
-		w.Logger.Debugf("Pushing %s to %s", uuid, LIST_QUEUE)
-		w.rc.PushTaskToList(uuid, LIST_QUEUE)
+		w.retryTask(uuid, taskDetails)
 		return
 	}
 
 	// run task handler
 	w.Logger.Debugf("Calling %s failure handler with args %+v", uuid, taskDetails.Arguments)
-	err = w.handler(w.Logger, taskDetails.Arguments)
+	stopLease := w.startLease(uuid, LIST_FAILURE_PROCESSING, taskDetails)
+	result, err := w.callHandler(taskDetails)
+	stopLease()
 
 	// delete task if no error in handler
 	if err == nil {
-		w.Logger.Debug("Deleting task:", uuid)
 		// delete a processed task, if success
-		if err := w.rc.DeleteTask(uuid); err != nil {
-			w.Logger.Errorf("DeleteTask(\"%s\") call failed: %+v", uuid, err)
-		}
+		w.deleteTask(uuid, taskDetails, result)
+		return
+	}
+
+	// the handler was cancelled on shutdown, let it run again later
+	if w.interrupted() {
+		w.Logger.Infof("Handler call for task \"%s\" interrupted: %+v", uuid, err)
+		w.finishTask(uuid, &Transition{To: LIST_FAILURE})
 		return
 	}
 
@@ -104,6 +91,46 @@ func (w *FailureWorker) processTask(uuid string) {
 	w.markTaskAsFailed(uuid, err, taskDetails, true)
 }
 
+// returns the task back to the queue, either immediately or through the retry set
+// (the worker never sleeps, so that a delayed retry does not hold up other failed tasks)
+func (w *FailureWorker) retryTask(uuid string, taskDetails *TaskDetails) error {
+	policy := w.retryPolicy(taskDetails)
+	if policy == nil {
+		return w.finishTask(uuid, &Transition{To: priorityList(LIST_QUEUE, taskDetails.Priority)})
+	}
+
+	return w.finishTask(uuid, w.retryTransition(uuid, taskDetails, policy))
+}
+
+// the retry policy of the task, falls back to a fixed delay of SleepTime
+func (w *FailureWorker) retryPolicy(taskDetails *TaskDetails) RetryPolicy {
+	if policy := w.Worker.retryPolicy(taskDetails); policy != nil {
+		return policy
+	}
+
+	if w.SleepTime > 0 {
+		return &FixedBackoff{Delay: time.Duration(w.SleepTime) * time.Millisecond}
+	}
+
+	return nil
+}
+
+// pick an item from the failure queue, waits until there is one,
+// returns an empty string if the worker must stop
+func (w *FailureWorker) pickTask() (string, error) {
+	for !w.stopped() {
+		// retries are parked in the retry set, see retryTask
+		w.promoteDueTasks()
+
+		uuid, err := w.backend.PickTaskTimeout(LIST_FAILURE, LIST_FAILURE_PROCESSING, DEFAULT_PICK_TIMEOUT)
+		if err != nil || uuid != "" {
+			return uuid, err
+		}
+	}
+
+	return "", nil
+}
+
 // Get worker instance id
 func (w *FailureWorker) GetInstanceId() int {
 	return w.id
@@ -111,7 +138,7 @@ func (w *FailureWorker) GetInstanceId() int {
 
 // Get worker instance id
 func (w *FailureWorker) GetTaskType() string {
-	return w.rc.taskType
+	return w.backend.TaskType()
 }
 
 // Run a worker (normally use a goroutine to allow concurrent workers)
@@ -119,18 +146,28 @@ func (w *FailureWorker) Run() {
 	w.Logger.Debug("started")
 	for {
 		// pick an item from the queue
-		uuid, err := w.rc.PickTask(LIST_FAILURE, LIST_FAILURE_PROCESSING)
+		uuid, err := w.pickTask()
+
+		// the connection may be closed on shutdown
+		if w.stopped() && (err != nil || uuid == "") {
+			w.Logger.Debug("stopped")
+			return
+		}
 
 		if err != nil {
-			w.failure <- WorkerFatalError{
+			select {
+			case w.failure <- WorkerFatalError{
 				WorkerError: WorkerError{
 					Worker: w,
 					Err:    err,
 				},
+			}:
+			case <-w.stop:
 			}
 			return
 		}
 
+		w.setOwner(uuid)
 		w.processTask(uuid)
 	}
 }
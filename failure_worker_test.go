@@ -16,14 +16,6 @@ const (
 
 func getFailureRedisConnMock(t *testing.T) *redigomock.Conn {
 	conn := redigomock.NewConn()
-	// RemoveOneFromList
-	conn.Command(
-		"LREM",
-		fmt.Sprintf("%s:%s:%s", FAILURE_WORKER_REDIS_PREFIX, LIST_PROCESSING, FAILURE_WORKER_TASK_TYPE),
-		1,
-		FAILURE_WORKER_TASK_UUID,
-	)
-
 	// GetTaskDetails
 	originalTaskDetails := getWorkerTaskDetails()
 	jsonTaskDetails, err := json.Marshal(originalTaskDetails)
@@ -48,33 +40,8 @@ func getFailureRedisConnMock(t *testing.T) *redigomock.Conn {
 		jsonModifiedTaskDetails,
 	)
 
-	// PushTaskToList
-	conn.Command(
-		"LPUSH",
-		fmt.Sprintf("%s:%s:%s", FAILURE_WORKER_REDIS_PREFIX, LIST_FAILURE_FINAL, FAILURE_WORKER_TASK_TYPE),
-		FAILURE_WORKER_TASK_UUID,
-	)
-
-	// PushTaskToList
-	conn.Command(
-		"LPUSH",
-		fmt.Sprintf("%s:%s:%s", FAILURE_WORKER_REDIS_PREFIX, LIST_QUEUE, FAILURE_WORKER_TASK_TYPE),
-		FAILURE_WORKER_TASK_UUID,
-	)
-
-	// PushTaskToList
-	conn.Command(
-		"LREM",
-		fmt.Sprintf("%s:%s:%s", FAILURE_WORKER_REDIS_PREFIX, LIST_FAILURE_PROCESSING, FAILURE_WORKER_TASK_TYPE),
-		1,
-		FAILURE_WORKER_TASK_UUID,
-	)
-
-	// PushTaskToList
-	conn.Command(
-		"DEL",
-		fmt.Sprintf("%s:%s:%s:%s", FAILURE_WORKER_REDIS_PREFIX, QUEUE_TASK, FAILURE_WORKER_TASK_TYPE, FAILURE_WORKER_TASK_UUID),
-	)
+	// FinishTask (task returned to the queue)
+	expectFinishTask(conn, LIST_FAILURE_PROCESSING, LIST_QUEUE, nil, nil, "")
 
 	return conn
 }
@@ -94,6 +61,8 @@ func TestFailureWorker_processTask(t *testing.T) {
 	})
 
 	w := NewFailureWorker(1, conn, FAILURE_WORKER_REDIS_PREFIX, FAILURE_WORKER_TASK_TYPE, handler, failure)
+	// return the task to the queue at once
+	w.SleepTime = 0
 	w.processTask(FAILURE_WORKER_TASK_UUID)
 
 	if len(conn.Errors) > 0 {
@@ -101,6 +70,32 @@ func TestFailureWorker_processTask(t *testing.T) {
 	}
 }
 
+func TestFailureWorker_pickTask_PromotesRetries(t *testing.T) {
+	conn := redigomock.NewConn()
+	promote := conn.GenericCommand("EVALSHA").Expect(int64(1))
+	conn.Command("BRPOPLPUSH",
+		fmt.Sprintf("%s:%s:%s", FAILURE_WORKER_REDIS_PREFIX, LIST_FAILURE, FAILURE_WORKER_TASK_TYPE),
+		fmt.Sprintf("%s:%s:%s", FAILURE_WORKER_REDIS_PREFIX, LIST_FAILURE_PROCESSING, FAILURE_WORKER_TASK_TYPE),
+		int64(1),
+	).Expect([]byte(FAILURE_WORKER_TASK_UUID))
+
+	w := NewFailureWorker(1, conn, FAILURE_WORKER_REDIS_PREFIX, FAILURE_WORKER_TASK_TYPE, nil, make(chan error))
+
+	// without a daemon scheduler, the retries parked by the worker are promoted by itself
+	uuid, err := w.pickTask()
+	if err != nil || uuid != FAILURE_WORKER_TASK_UUID {
+		t.Fatalf("Expected task %s to be picked, got %s, %+v", FAILURE_WORKER_TASK_UUID, uuid, err)
+	}
+
+	if conn.Stats(promote) != 1 {
+		t.Error("Due retries are expected to be promoted before picking")
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
 func TestFailureWorker_GetInstanceId(t *testing.T) {
 	failure := make(chan error, 0)
 	conn := getFailureRedisConnMock(t)
@@ -0,0 +1,550 @@
+// Package goredis runs redisq on top of a go-redis client, sharing its pooling, TLS and tracing setup
+//
+//	client := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{"localhost:6379"}})
+//	d := redisq.NewDaemon("mail", 4, "redisq", "")
+//	d.Dial = goredis.Dialer(client)
+//
+// A connection may be also passed to redisq.NewRedisClient to enqueue tasks.
+// Every command is run on a connection taken from the client pool, so the commands that need a dedicated
+// connection (SUBSCRIBE, WATCH) are not supported; MULTI ... EXEC is run as a transactional pipeline.
+// With a cluster client set RedisClient.Cluster (Daemon.Cluster), so that the keys of a task type share a slot.
+package goredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/go-extras/redisq"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned by the calls on a closed connection
+var ErrClosed = errors.New("Connection is closed")
+
+// redigo connection running the commands through a go-redis client
+type Conn struct {
+	client redis.UniversalClient
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	// commands queued by Send
+	pending [][]interface{}
+	// replies of the flushed commands, not received yet
+	replies []interface{}
+	err     error
+}
+
+var _ redigo.Conn = &Conn{}
+
+// Instantiates Conn class, closing the connection does not close the client
+func NewConn(client redis.UniversalClient) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Conn{client: client, ctx: ctx, cancel: cancel}
+}
+
+// returns a DialFunc creating connections on top of the client (see Daemon.Dial)
+func Dialer(client redis.UniversalClient) redisq.DialFunc {
+	return func() (redigo.Conn, error) {
+		return NewConn(client), nil
+	}
+}
+
+// Instantiates redisq.RedisClient on top of the client
+func NewRedisClient(client redis.UniversalClient, prefix, taskType string) *redisq.RedisClient {
+	return redisq.NewRedisClient(NewConn(client), prefix, taskType)
+}
+
+// cancels the commands in progress and returns at once, the client is left open
+func (c *Conn) Close() error {
+	c.cancel()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == ErrClosed {
+		return ErrClosed
+	}
+
+	c.err = ErrClosed
+	c.pending = nil
+	c.replies = nil
+
+	return nil
+}
+
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// queues a command until Flush or Do
+func (c *Conn) Send(commandName string, args ...interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+
+	c.pending = append(c.pending, append([]interface{}{commandName}, args...))
+
+	return nil
+}
+
+// takes the queued commands, the lock is never held while the commands run (so that Close does not wait for them)
+func (c *Conn) takePending() ([][]interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	queued := c.pending
+	c.pending = nil
+
+	return queued, nil
+}
+
+// keeps the replies of the flushed commands for Receive, unless the connection has been closed meanwhile
+func (c *Conn) addReplies(replies []interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil {
+		c.replies = append(c.replies, replies...)
+	}
+}
+
+// runs the queued commands as a pipeline, their replies are returned by Receive
+func (c *Conn) Flush() error {
+	queued, err := c.takePending()
+	if err != nil {
+		return err
+	}
+
+	replies, err := c.flush(queued)
+	if err != nil {
+		return err
+	}
+	c.addReplies(replies)
+
+	return nil
+}
+
+// returns the reply to the next flushed command
+func (c *Conn) Receive() (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	if len(c.replies) == 0 {
+		return nil, errors.New("No reply to receive, Receive is not supported for pub/sub")
+	}
+
+	reply := c.replies[0]
+	c.replies = c.replies[1:]
+	if err, ok := reply.(redigo.Error); ok {
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+// runs the queued commands and then the command, returns the reply to the latter
+// (an empty command name only runs the queued commands and returns the last reply)
+func (c *Conn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	queued, err := c.takePending()
+	if err != nil {
+		return nil, err
+	}
+
+	command := strings.ToUpper(commandName)
+	if command == "EXEC" || command == "DISCARD" {
+		return c.transaction(command, queued)
+	}
+
+	replies, err := c.flush(queued)
+	if err != nil {
+		return nil, err
+	}
+
+	if commandName == "" {
+		c.mu.Lock()
+		replies = append(c.replies, replies...)
+		c.replies = nil
+		c.mu.Unlock()
+
+		if len(replies) == 0 {
+			return nil, nil
+		}
+		return replyOrError(replies[len(replies)-1])
+	}
+
+	// the replies not received yet are dropped, the first error among them is returned, as redigo does
+	c.mu.Lock()
+	replies = append(c.replies, replies...)
+	c.replies = nil
+	c.mu.Unlock()
+
+	reply, err := c.do(append([]interface{}{commandName}, args...))
+	if pendingErr := firstError(replies); pendingErr != nil {
+		return reply, pendingErr
+	}
+
+	return reply, err
+}
+
+// returns the first Redis error among the replies
+func firstError(replies []interface{}) error {
+	for _, reply := range replies {
+		if err, ok := reply.(redigo.Error); ok {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runs the commands queued after MULTI as a transaction (or discards them)
+func (c *Conn) transaction(command string, queued [][]interface{}) (interface{}, error) {
+	start := -1
+	for i, args := range queued {
+		if name, ok := args[0].(string); ok && strings.EqualFold(name, "MULTI") {
+			start = i
+		}
+	}
+	if start < 0 {
+		c.mu.Lock()
+		c.pending = append(queued, c.pending...)
+		c.mu.Unlock()
+		return nil, redigo.Error(fmt.Sprintf("ERR %s without MULTI", command))
+	}
+
+	// commands queued before MULTI
+	replies, err := c.flush(queued[:start])
+	if err != nil {
+		return nil, err
+	}
+	c.addReplies(replies)
+
+	if command == "DISCARD" {
+		return []byte("OK"), nil
+	}
+
+	cmds, err := c.client.TxPipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		for _, args := range queued[start+1:] {
+			pipe.Do(c.ctx, args...)
+		}
+		return nil
+	})
+
+	return execReplies(cmds, err)
+}
+
+// runs the commands as a pipeline
+func (c *Conn) flush(queued [][]interface{}) ([]interface{}, error) {
+	if len(queued) == 0 {
+		return nil, nil
+	}
+
+	cmds, err := c.client.Pipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		for _, args := range queued {
+			pipe.Do(c.ctx, args...)
+		}
+		return nil
+	})
+
+	return execReplies(cmds, err)
+}
+
+// runs a single command, the blocking ones through the go-redis calls extending the read timeout
+func (c *Conn) do(args []interface{}) (interface{}, error) {
+	switch strings.ToUpper(fmt.Sprint(args[0])) {
+	case "BRPOPLPUSH":
+		if len(args) == 4 {
+			return c.brpoplpush(args[1:])
+		}
+	case "BLPOP":
+		if len(args) >= 3 {
+			return c.blpop(args[1:])
+		}
+	case "XREADGROUP":
+		return c.xreadgroup(args[1:])
+	}
+
+	return convertReply(c.client.Do(c.ctx, args...).Result())
+}
+
+// runs a blocking command, the one without timeout in one second rounds,
+// so that it stops once the connection is closed (a reply is not nil unless the command timed out)
+func (c *Conn) blocking(timeout time.Duration, run func(timeout time.Duration) (interface{}, error)) (interface{}, error) {
+	if timeout > 0 {
+		return run(timeout)
+	}
+
+	for {
+		reply, err := run(time.Second)
+		if reply != nil || err != nil {
+			return reply, err
+		}
+
+		if c.ctx.Err() != nil {
+			return nil, ErrClosed
+		}
+	}
+}
+
+func (c *Conn) brpoplpush(args []interface{}) (interface{}, error) {
+	timeout, err := parseSeconds(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	return c.blocking(timeout, func(timeout time.Duration) (interface{}, error) {
+		return convertReply(c.client.BRPopLPush(c.ctx, fmt.Sprint(args[0]), fmt.Sprint(args[1]), timeout).Result())
+	})
+}
+
+func (c *Conn) blpop(args []interface{}) (interface{}, error) {
+	timeout, err := parseSeconds(args[len(args)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(args)-1)
+	for i, key := range args[:len(args)-1] {
+		keys[i] = fmt.Sprint(key)
+	}
+
+	return c.blocking(timeout, func(timeout time.Duration) (interface{}, error) {
+		reply, err := c.client.BLPop(c.ctx, timeout, keys...).Result()
+		if err != nil {
+			return convertReply(nil, err)
+		}
+
+		return convertReply(reply, nil)
+	})
+}
+
+func (c *Conn) xreadgroup(args []interface{}) (interface{}, error) {
+	a, err := parseXReadGroupArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	// without BLOCK the command does not block at all
+	if a.Block < 0 {
+		return c.readGroup(a)
+	}
+
+	return c.blocking(a.Block, func(timeout time.Duration) (interface{}, error) {
+		a.Block = timeout
+		return c.readGroup(a)
+	})
+}
+
+func (c *Conn) readGroup(a *redis.XReadGroupArgs) (interface{}, error) {
+	streams, err := c.client.XReadGroup(c.ctx, a).Result()
+	if err != nil {
+		return convertReply(nil, err)
+	}
+
+	// [[stream, [[id, [field, value, ...]], ...]], ...]
+	reply := make([]interface{}, len(streams))
+	for i, stream := range streams {
+		messages := make([]interface{}, len(stream.Messages))
+		for j, message := range stream.Messages {
+			var fields interface{}
+			if message.Values != nil {
+				fields = flattenMap(message.Values)
+			}
+			messages[j] = []interface{}{[]byte(message.ID), fields}
+		}
+		reply[i] = []interface{}{[]byte(stream.Stream), messages}
+	}
+
+	return reply, nil
+}
+
+// parses GROUP <group> <consumer> [COUNT <count>] [BLOCK <ms>] [NOACK] STREAMS <key> ... <id> ...
+func parseXReadGroupArgs(args []interface{}) (*redis.XReadGroupArgs, error) {
+	a := &redis.XReadGroupArgs{Block: -1}
+
+	for i := 0; i < len(args); i++ {
+		option := strings.ToUpper(fmt.Sprint(args[i]))
+		switch {
+		case option == "GROUP" && i+2 < len(args):
+			a.Group, a.Consumer = fmt.Sprint(args[i+1]), fmt.Sprint(args[i+2])
+			i += 2
+		case option == "COUNT" && i+1 < len(args):
+			count, err := strconv.ParseInt(fmt.Sprint(args[i+1]), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			a.Count = count
+			i++
+		case option == "BLOCK" && i+1 < len(args):
+			ms, err := strconv.ParseInt(fmt.Sprint(args[i+1]), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			a.Block = time.Duration(ms) * time.Millisecond
+			i++
+		case option == "NOACK":
+			a.NoAck = true
+		case option == "STREAMS":
+			for _, arg := range args[i+1:] {
+				a.Streams = append(a.Streams, fmt.Sprint(arg))
+			}
+			i = len(args)
+		default:
+			return nil, fmt.Errorf("Unsupported XREADGROUP option \"%s\"", option)
+		}
+	}
+
+	if a.Group == "" || len(a.Streams) == 0 || len(a.Streams)%2 != 0 {
+		return nil, errors.New("Malformed XREADGROUP arguments")
+	}
+
+	return a, nil
+}
+
+// parses a blocking command timeout in seconds
+func parseSeconds(arg interface{}) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(fmt.Sprint(arg), 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// collects the replies of a pipeline, Redis errors are returned as the replies (as redigo does for EXEC)
+func execReplies(cmds []redis.Cmder, err error) ([]interface{}, error) {
+	replies := make([]interface{}, len(cmds))
+	for i, cmd := range cmds {
+		var reply interface{}
+		var cmdErr error
+		if c, ok := cmd.(*redis.Cmd); ok {
+			reply, cmdErr = convertReply(c.Result())
+		} else {
+			reply, cmdErr = convertReply(nil, cmd.Err())
+		}
+
+		if e, ok := cmdErr.(redigo.Error); ok {
+			reply = e
+		} else if cmdErr != nil {
+			return nil, cmdErr
+		}
+		replies[i] = reply
+	}
+
+	// the pipeline failed before running any command
+	if err != nil && len(cmds) == 0 {
+		return nil, convertError(err)
+	}
+
+	return replies, nil
+}
+
+func replyOrError(reply interface{}) (interface{}, error) {
+	if err, ok := reply.(redigo.Error); ok {
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+// converts a Redis error to redigo.Error, so that redigo recognizes it (e.g. NOSCRIPT for scripts)
+func convertError(err error) error {
+	if err == redis.Nil {
+		return nil
+	}
+
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) {
+		return redigo.Error(redisErr.Error())
+	}
+
+	return err
+}
+
+// converts a go-redis reply to the one redigo returns (strings are bulk strings, nil replies are nil)
+func convertReply(reply interface{}, err error) (interface{}, error) {
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	switch v := reply.(type) {
+	case string:
+		return []byte(v), nil
+	case []string:
+		values := make([]interface{}, len(v))
+		for i, s := range v {
+			values[i] = []byte(s)
+		}
+		return values, nil
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, value := range v {
+			values[i] = convertValue(value)
+		}
+		return values, nil
+	default:
+		return convertValue(v), nil
+	}
+}
+
+// converts a nested value (RESP3 maps and sets are returned as flat arrays)
+func convertValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return []byte(v)
+	case bool:
+		if v {
+			return int64(1)
+		}
+		return int64(0)
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64))
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = convertValue(item)
+		}
+		return values
+	case map[interface{}]interface{}:
+		values := make([]interface{}, 0, len(v)*2)
+		for key, item := range v {
+			values = append(values, convertValue(key), convertValue(item))
+		}
+		return values
+	case map[string]interface{}:
+		return flattenMap(v)
+	case redis.Error:
+		return redigo.Error(v.Error())
+	default:
+		return v
+	}
+}
+
+func flattenMap(m map[string]interface{}) []interface{} {
+	values := make([]interface{}, 0, len(m)*2)
+	for key, item := range m {
+		values = append(values, []byte(key), convertValue(item))
+	}
+
+	return values
+}
@@ -0,0 +1,303 @@
+package goredis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/redis/go-redis/v9"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConvertReply(t *testing.T) {
+	reply, err := convertReply([]interface{}{"uuid", int64(1), nil, []interface{}{"nested"}, true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []interface{}{[]byte("uuid"), int64(1), nil, []interface{}{[]byte("nested")}, int64(1)}
+	if !reflect.DeepEqual(reply, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, reply)
+	}
+
+	if uuid, err := redigo.String(convertReply("uuid", nil)); err != nil || uuid != "uuid" {
+		t.Errorf("Expected a bulk string to be readable by redigo, got %s, %+v", uuid, err)
+	}
+
+	if _, err := redigo.String(convertReply(nil, redis.Nil)); err != redigo.ErrNil {
+		t.Errorf("Expected a nil reply to be redigo.ErrNil, got %+v", err)
+	}
+}
+
+func TestConvertError(t *testing.T) {
+	failure := errors.New("connection refused")
+	if err := convertError(failure); err != failure {
+		t.Errorf("Expected a network error to be returned as is, got %+v", err)
+	}
+
+	// a Redis error as parsed by go-redis
+	cmd := redis.NewCmd(context.Background())
+	cmd.SetErr(redisError("NOSCRIPT No matching script"))
+	if _, err := convertReply(cmd.Result()); !reflect.DeepEqual(err, redigo.Error("NOSCRIPT No matching script")) {
+		t.Errorf("Expected a Redis error to be converted to redigo.Error, got %#v", err)
+	}
+}
+
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+func (redisError) RedisError() {}
+
+func TestParseXReadGroupArgs(t *testing.T) {
+	a, err := parseXReadGroupArgs([]interface{}{"GROUP", "workers", "consumer", "COUNT", 1, "BLOCK", int64(1000), "STREAMS", "redisq:mail:stream", ">"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &redis.XReadGroupArgs{
+		Group:    "workers",
+		Consumer: "consumer",
+		Streams:  []string{"redisq:mail:stream", ">"},
+		Count:    1,
+		Block:    time.Second,
+	}
+	if !reflect.DeepEqual(a, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, a)
+	}
+
+	if _, err := parseXReadGroupArgs([]interface{}{"GROUP", "workers", "consumer", "STREAMS", "redisq:mail:stream"}); err == nil {
+		t.Error("Expected an error for a stream without an id")
+	}
+}
+
+func TestConn_Close(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:0"})
+	defer client.Close()
+
+	conn := NewConn(client)
+	if err := conn.Send("MULTI"); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply, err := conn.Do("DISCARD"); err != nil || string(reply.([]byte)) != "OK" {
+		t.Errorf("Expected queued commands to be discarded, got %+v, %+v", reply, err)
+	}
+
+	if _, err := conn.Do("EXEC"); err == nil {
+		t.Error("Expected EXEC without MULTI to fail")
+	}
+
+	conn.Close()
+	if _, err := conn.Do("PING"); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %+v", err)
+	}
+
+	if conn.Err() != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %+v", conn.Err())
+	}
+}
+
+// serves the RESP commands by the reply function, nothing is replied if it returns an empty string
+func serveRESP(t *testing.T, reply func(args []string) string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+
+			go func() {
+				r := bufio.NewReader(conn)
+				for {
+					args, err := readCommand(r)
+					if err != nil {
+						return
+					}
+					if response := reply(args); response != "" {
+						conn.Write([]byte(response))
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// reads a command sent as an array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+
+	return args, nil
+}
+
+func newTestClient(t *testing.T, reply func(args []string) string) redis.UniversalClient {
+	addr := serveRESP(t, func(args []string) string {
+		if strings.EqualFold(args[0], "HELLO") {
+			return "-ERR unknown command 'HELLO'\r\n"
+		}
+		return reply(args)
+	})
+
+	client := redis.NewClient(&redis.Options{Addr: addr, DisableIndentity: true, MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func TestConn_Exec_RuntimeError(t *testing.T) {
+	conn := NewConn(newTestClient(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "MULTI":
+			return "+OK\r\n"
+		case "EXEC":
+			return "*2\r\n$4\r\nuuid\r\n-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+		default:
+			return "+QUEUED\r\n"
+		}
+	}))
+
+	conn.Send("MULTI")
+	conn.Send("GET", "task")
+	conn.Send("LPUSH", "queue", "uuid")
+	reply, err := conn.Do("EXEC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []interface{}{[]byte("uuid"), redigo.Error("WRONGTYPE Operation against a key holding the wrong kind of value")}
+	if !reflect.DeepEqual(reply, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, reply)
+	}
+}
+
+func TestConn_Do_PendingError(t *testing.T) {
+	conn := NewConn(newTestClient(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "INCR":
+			return "-ERR value is not an integer or out of range\r\n"
+		case "GET":
+			return "$4\r\nuuid\r\n"
+		default:
+			return "+OK\r\n"
+		}
+	}))
+
+	conn.Send("SET", "a", "b")
+	conn.Send("INCR", "a")
+	conn.Send("SET", "c", "d")
+	reply, err := conn.Do("GET", "task")
+
+	expected := redigo.Error("ERR value is not an integer or out of range")
+	if err != expected {
+		t.Errorf("Expected %+v, got %+v", expected, err)
+	}
+
+	if !reflect.DeepEqual(reply, []byte("uuid")) {
+		t.Errorf("Expected the reply to the command, got %+v", reply)
+	}
+
+	if reply, err := conn.Do("GET", "task"); err != nil || !reflect.DeepEqual(reply, []byte("uuid")) {
+		t.Errorf("Expected the pending replies to be dropped, got %+v, %+v", reply, err)
+	}
+}
+
+func TestConn_Script_NoScript(t *testing.T) {
+	var mu sync.Mutex
+	var commands []string
+	conn := NewConn(newTestClient(t, func(args []string) string {
+		mu.Lock()
+		commands = append(commands, strings.ToUpper(args[0]))
+		mu.Unlock()
+
+		if strings.EqualFold(args[0], "EVALSHA") {
+			return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+		}
+		return ":1\r\n"
+	}))
+
+	script := redigo.NewScript(1, `return 1`)
+	if n, err := redigo.Int(script.Do(conn, "key")); err != nil || n != 1 {
+		t.Fatalf("Expected the script to fall back to EVAL, got %d, %+v", n, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(commands, []string{"EVALSHA", "EVAL"}) {
+		t.Errorf("Expected EVALSHA and then EVAL, got %+v", commands)
+	}
+}
+
+func TestConn_Close_Blocking(t *testing.T) {
+	conn := NewConn(newTestClient(t, func(args []string) string {
+		// the queue is empty, a nil reply once the timeout passes
+		if strings.EqualFold(args[0], "BRPOPLPUSH") {
+			seconds, _ := strconv.Atoi(args[3])
+			time.Sleep(time.Duration(seconds) * time.Second)
+			return "$-1\r\n"
+		}
+		return "+OK\r\n"
+	}))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Do("BRPOPLPUSH", "queue", "processing", 0)
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		conn.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close is expected not to wait for the blocking command")
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Blocking command is expected to fail once the connection is closed")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Blocking command is expected to stop once the connection is closed")
+	}
+}
@@ -0,0 +1,161 @@
+package redisq
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// suffix of the sorted sets of lease deadlines (unix ms) of the tasks in the processing lists
+const ZSET_LEASES_SUFFIX = "_leases"
+
+// moves a task with a lapsed lease from the processing list back to a queue,
+// unless the lease has been renewed or the task has finished meanwhile
+var requeueLapsedScript = redis.NewScript(4, `
+local deadline = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if not deadline or tonumber(deadline) > tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("ZREM", KEYS[1], ARGV[1])
+if redis.call("LREM", KEYS[2], 1, ARGV[1]) == 0 then
+	return 0
+end
+redis.call("HDEL", KEYS[4], ARGV[1])
+redis.call("LPUSH", KEYS[3], ARGV[1])
+return 1
+`)
+
+// name of the sorted set with lease deadlines of a processing list
+func leaseSet(processing string) string {
+	return processing + ZSET_LEASES_SUFFIX
+}
+
+// records the lease deadline of a task in the processing list
+func (rc *RedisClient) SetLease(uuid, processing string, deadline time.Time) error {
+	_, err := rc.conn.Do("ZADD", rc.listKey(leaseSet(processing)), timeToScore(deadline), uuid)
+
+	return err
+}
+
+// moves the lease deadline, unless the lease has been already taken away
+func (rc *RedisClient) RenewLease(uuid, processing string, deadline time.Time) error {
+	_, err := rc.conn.Do("ZADD", rc.listKey(leaseSet(processing)), "XX", timeToScore(deadline), uuid)
+
+	return err
+}
+
+// returns up to limit tasks whose leases lapsed before now
+func (rc *RedisClient) GetLapsedLeases(processing string, now time.Time, limit int) ([]string, error) {
+	return redis.Strings(rc.conn.Do(
+		"ZRANGEBYSCORE",
+		rc.listKey(leaseSet(processing)),
+		"-inf",
+		timeToScore(now),
+		"LIMIT",
+		0,
+		limit,
+	))
+}
+
+// atomically moves a task with a lapsed lease from the processing list to the target list,
+// returns false if the lease has been renewed or the task is not processed anymore
+func (rc *RedisClient) RequeueLapsedTask(uuid, processing, to string, now time.Time) (bool, error) {
+	return redis.Bool(requeueLapsedScript.Do(
+		rc.conn,
+		rc.listKey(leaseSet(processing)),
+		rc.listKey(processing),
+		rc.listKey(to),
+		rc.listKey(HASH_OWNERS),
+		uuid,
+		timeToScore(now),
+	))
+}
+
+// visibility timeout of a task, zero if leases are disabled
+func (w *Worker) leaseTimeout(taskDetails *TaskDetails) time.Duration {
+	if taskDetails.VisibilityTimeout > 0 {
+		return time.Duration(taskDetails.VisibilityTimeout) * time.Millisecond
+	}
+
+	return time.Duration(w.VisibilityTimeout) * time.Millisecond
+}
+
+// takes a lease on the task and keeps renewing it until the returned function is called
+// (the worker connection must not be used in between), the lease is removed when the task is finished
+func (w *Worker) startLease(uuid, processing string, taskDetails *TaskDetails) func() {
+	timeout := w.leaseTimeout(taskDetails)
+	if timeout <= 0 {
+		return func() {}
+	}
+
+	if err := w.backend.SetLease(uuid, processing, time.Now().Add(timeout)); err != nil {
+		w.Logger.Errorf("SetLease(\"%s\", \"%s\") call failed: %+v", uuid, processing, err)
+	}
+
+	return w.keepRenewing(timeout, func() {
+		w.Logger.Debugf("Renewing %s lease", uuid)
+		if err := w.backend.RenewLease(uuid, processing, time.Now().Add(timeout)); err != nil {
+			w.Logger.Errorf("RenewLease(\"%s\", \"%s\") call failed: %+v", uuid, processing, err)
+		}
+	})
+}
+
+// calls renew every third of the timeout until the returned function is called
+func (w *Worker) keepRenewing(timeout time.Duration, renew func()) func() {
+	if timeout <= 0 {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(timeout / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				renew()
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// returns tasks with lapsed leases to their queues
+func (d *Daemon) requeueLapsedTasks(rc *RedisClient, logger Logger) error {
+	for _, processing := range []string{LIST_PROCESSING, LIST_FAILURE_PROCESSING} {
+		now := time.Now()
+		uuids, err := rc.GetLapsedLeases(processing, now, DEFAULT_PROMOTE_BATCH_SIZE)
+		if err != nil {
+			return err
+		}
+
+		for _, uuid := range uuids {
+			to := LIST_FAILURE
+			if processing == LIST_PROCESSING {
+				to = LIST_QUEUE
+				if taskDetails, err := rc.GetTaskDetails(uuid); err == nil {
+					to = priorityList(LIST_QUEUE, taskDetails.Priority)
+				}
+			}
+
+			moved, err := rc.RequeueLapsedTask(uuid, processing, to, now)
+			if err != nil {
+				return err
+			}
+
+			if moved {
+				logger.Infof("Lease of task %s lapsed, moved from %s to %s", uuid, processing, to)
+			}
+		}
+	}
+
+	return nil
+}
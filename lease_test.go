@@ -0,0 +1,48 @@
+package redisq
+
+import (
+	"github.com/rafaeljusto/redigomock"
+	"testing"
+)
+
+func TestWorker_processTask_Lease(t *testing.T) {
+	failure := make(chan error, 0)
+	conn := getRedisConnMock(t)
+	setLease := conn.GenericCommand("ZADD")
+
+	handler := WorkerHandler(func(logger Logger, args []string) error {
+		if conn.Stats(setLease) != 1 {
+			t.Error("Lease is expected to be taken before the handler is called")
+		}
+		return nil
+	})
+
+	w := NewWorker(1, conn, WORKER_REDIS_PREFIX, WORKER_TASK_TYPE, handler, failure)
+	w.VisibilityTimeout = 60000
+	w.processTask(WORKER_TASK_UUID)
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestDaemon_requeueLapsedTasks(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.GenericCommand("ZRANGEBYSCORE").
+		Expect([]interface{}{}).
+		Expect([]interface{}{[]byte(CLIENT_TASK_UUID)})
+	requeue := conn.GenericCommand("EVALSHA").Expect(int64(1))
+
+	d := NewDaemon(CLIENT_TASK_TYPE, 1, CLIENT_REDIS_PREFIX, "")
+	if err := d.requeueLapsedTasks(getRedisClient(conn), d.Logger); err != nil {
+		t.Fatal(err)
+	}
+
+	if conn.Stats(requeue) != 1 {
+		t.Error("Task with a lapsed lease is expected to be requeued")
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
@@ -0,0 +1,432 @@
+package redisq
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// how often a waiting pick checks for due scheduled tasks and retries
+const memoryPollInterval = 50 * time.Millisecond
+
+// Backend keeping the tasks of a type in memory, with the same semantics as RedisClient, except that nothing expires
+// (results are kept as long as the backend, unique keys until released) and the tasks of dead owners are not reaped,
+// tasks with lapsed leases are returned to their queues on the next pick
+type MemoryBackend struct {
+	taskType string
+	// used to encode task details
+	Codec Codec
+	mu    sync.Mutex
+	// closed and replaced whenever an item is pushed to a list
+	changed chan struct{}
+	// items are pushed to the head (index 0) and picked from the tail
+	lists map[string][]string
+	tasks map[string][]byte
+	// sorted sets of scheduled tasks and retries, by time they are due at
+	scheduled map[string]map[string]time.Time
+	owners    map[string]string
+	// lease deadlines by lease set
+	leases  map[string]map[string]time.Time
+	results map[string]*TaskResult
+	unique  map[string]string
+}
+
+var _ Backend = &RedisClient{}
+var _ Backend = &MemoryBackend{}
+
+func NewMemoryBackend(taskType string) *MemoryBackend {
+	return &MemoryBackend{
+		taskType:  taskType,
+		Codec:     &JSONCodec{},
+		changed:   make(chan struct{}),
+		lists:     map[string][]string{},
+		tasks:     map[string][]byte{},
+		scheduled: map[string]map[string]time.Time{},
+		owners:    map[string]string{},
+		leases:    map[string]map[string]time.Time{},
+		results:   map[string]*TaskResult{},
+		unique:    map[string]string{},
+	}
+}
+
+// type of the tasks stored
+func (m *MemoryBackend) TaskType() string {
+	return m.taskType
+}
+
+// pushes an item to the head of the list and wakes up the waiting picks (must be called locked)
+func (m *MemoryBackend) push(list, uuid string) {
+	m.lists[list] = append([]string{uuid}, m.lists[list]...)
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// removes the first occurrence of an item from the head of the list (must be called locked)
+func (m *MemoryBackend) remove(list, uuid string) bool {
+	items := m.lists[list]
+	for i, item := range items {
+		if item == uuid {
+			m.lists[list] = append(items[:i:i], items[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// moves an item from the tail of a list to the head of another one (must be called locked)
+func (m *MemoryBackend) pop(from, to string) string {
+	items := m.lists[from]
+	if len(items) == 0 {
+		return ""
+	}
+
+	uuid := items[len(items)-1]
+	m.lists[from] = items[:len(items)-1]
+	m.push(to, uuid)
+
+	return uuid
+}
+
+// moves up to limit (all, if not positive) due scheduled tasks and retries to the queues,
+// the most urgent priority first, returns amount of moved tasks (must be called locked)
+func (m *MemoryBackend) promote(now time.Time, limit int) int {
+	moved := 0
+	for _, priority := range priorities {
+		for _, set := range []string{ZSET_SCHEDULED, ZSET_RETRY} {
+			zset := m.scheduled[priorityList(set, priority)]
+
+			var due []string
+			for uuid, at := range zset {
+				if !at.After(now) {
+					due = append(due, uuid)
+				}
+			}
+			sort.Slice(due, func(i, j int) bool {
+				return zset[due[i]].Before(zset[due[j]])
+			})
+
+			for _, uuid := range due {
+				if limit > 0 && moved >= limit {
+					return moved
+				}
+				delete(zset, uuid)
+				m.push(priorityList(LIST_QUEUE, priority), uuid)
+				moved++
+			}
+		}
+	}
+
+	return moved
+}
+
+// returns the tasks whose leases lapsed before now to their queues,
+// as Daemon does for RedisClient (must be called locked)
+func (m *MemoryBackend) requeueLapsed(now time.Time) {
+	for _, processing := range []string{LIST_PROCESSING, LIST_FAILURE_PROCESSING} {
+		leases := m.leases[leaseSet(processing)]
+		for uuid, deadline := range leases {
+			if deadline.After(now) {
+				continue
+			}
+
+			delete(leases, uuid)
+			if !m.remove(processing, uuid) {
+				continue
+			}
+			delete(m.owners, uuid)
+
+			to := LIST_FAILURE
+			if processing == LIST_PROCESSING {
+				to = LIST_QUEUE
+				var taskDetails TaskDetails
+				if err := decodeTaskDetails(m.tasks[uuid], &taskDetails); err == nil {
+					to = priorityList(LIST_QUEUE, taskDetails.Priority)
+				}
+			}
+			m.push(to, uuid)
+		}
+	}
+}
+
+// moves up to limit scheduled tasks and retries due at the given time to the queues, returns amount of moved tasks
+func (m *MemoryBackend) PromoteScheduledTasks(now time.Time, limit int) (int, error) {
+	if limit <= 0 {
+		limit = DEFAULT_PROMOTE_BATCH_SIZE
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.promote(now, limit), nil
+}
+
+// stores a new task (must be called locked)
+func (m *MemoryBackend) store(task *preparedTask) (string, error) {
+	if key := task.details.UniqueKey; key != "" {
+		if holder, ok := m.unique[key]; ok {
+			return holder, ErrDuplicateTask
+		}
+		m.unique[key] = task.uuid
+	}
+
+	m.tasks[task.uuid] = task.data
+	if task.runAt.IsZero() {
+		m.push(priorityList(LIST_QUEUE, task.details.Priority), task.uuid)
+	} else {
+		m.zadd(priorityList(ZSET_SCHEDULED, task.details.Priority), task.uuid, task.runAt)
+	}
+
+	return task.uuid, nil
+}
+
+func (m *MemoryBackend) zadd(zset, uuid string, at time.Time) {
+	if m.scheduled[zset] == nil {
+		m.scheduled[zset] = map[string]time.Time{}
+	}
+	m.scheduled[zset][uuid] = at
+}
+
+// creates a new task and puts it to the queue, returns uuid of the created task
+// If a task with the same UniqueKey is pending, its uuid is returned along with ErrDuplicateTask
+func (m *MemoryBackend) EnqueueTask(args []string, opts *EnqueueOptions) (string, error) {
+	task, err := prepareTask(m.Codec, m.taskType, args, opts)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store(task)
+}
+
+// creates a new task that is put to the queue not earlier than runAt
+func (m *MemoryBackend) ScheduleTask(args []string, runAt time.Time, opts *EnqueueOptions) (string, error) {
+	task, err := prepareTask(m.Codec, m.taskType, args, opts)
+	if err != nil {
+		return "", err
+	}
+	task.runAt = runAt
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store(task)
+}
+
+// waits for an item until the deadline (forever, if zero)
+func (m *MemoryBackend) pickUntil(from, to string, deadline time.Time) string {
+	for {
+		m.mu.Lock()
+		m.requeueLapsed(time.Now())
+		m.promote(time.Now(), 0)
+		uuid := m.pop(from, to)
+		changed := m.changed
+		m.mu.Unlock()
+
+		if uuid != "" {
+			return uuid
+		}
+
+		wait := memoryPollInterval
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return ""
+			}
+			if remaining < wait {
+				wait = remaining
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// moves an item from the list to another one, waits until there is one
+func (m *MemoryBackend) PickTask(from, to string) (string, error) {
+	return m.pickUntil(from, to, time.Time{}), nil
+}
+
+// moves an item from the list to another one, waits up to timeout for one,
+// returns an empty string if there is none
+func (m *MemoryBackend) PickTaskTimeout(from, to string, timeout time.Duration) (string, error) {
+	return m.pickUntil(from, to, time.Now().Add(timeout)), nil
+}
+
+// moves an item from the first non-empty list to another one, returns an empty string if all are empty
+func (m *MemoryBackend) PickTaskFromLists(from []string, to string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requeueLapsed(time.Now())
+	m.promote(time.Now(), 0)
+	for _, list := range from {
+		if uuid := m.pop(list, to); uuid != "" {
+			return uuid, nil
+		}
+	}
+
+	return "", nil
+}
+
+func (m *MemoryBackend) GetTaskDetails(uuid string) (*TaskDetails, error) {
+	m.mu.Lock()
+	data, ok := m.tasks[uuid]
+	m.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Task \"%s\" does not exist", uuid)
+	}
+
+	var taskDetails TaskDetails
+	if err := decodeTaskDetails(data, &taskDetails); err != nil {
+		return nil, err
+	}
+
+	return &taskDetails, nil
+}
+
+func (m *MemoryBackend) SaveTaskDetails(uuid string, taskDetails *TaskDetails) error {
+	data, err := m.Codec.Marshal(taskDetails)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.tasks[uuid] = data
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *MemoryBackend) PushTaskToList(uuid string, list string) error {
+	m.mu.Lock()
+	m.push(list, uuid)
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *MemoryBackend) DeleteTask(uuid string) error {
+	m.mu.Lock()
+	delete(m.tasks, uuid)
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *MemoryBackend) RemoveOneFromList(uuid, listName string) error {
+	m.mu.Lock()
+	m.remove(listName, uuid)
+	m.mu.Unlock()
+
+	return nil
+}
+
+// atomically applies a transition of a task leaving its processing list,
+// returns ErrTaskLost if the task has left the list meanwhile
+func (m *MemoryBackend) FinishTask(uuid string, t *Transition) error {
+	var details []byte
+	if t.To != "" && t.TaskDetails != nil {
+		var err error
+		if details, err = m.Codec.Marshal(t.TaskDetails); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.remove(t.Processing, uuid) {
+		return ErrTaskLost
+	}
+
+	delete(m.owners, uuid)
+	delete(m.leases[leaseSet(t.Processing)], uuid)
+
+	if t.To == "" {
+		delete(m.tasks, uuid)
+	} else {
+		if details != nil {
+			m.tasks[uuid] = details
+		}
+		if t.RunAt.IsZero() {
+			m.push(t.To, uuid)
+		} else {
+			m.zadd(t.To, uuid, t.RunAt)
+		}
+	}
+
+	if t.Result != nil {
+		m.results[uuid] = t.Result
+	}
+
+	if t.UniqueKey != "" && m.unique[t.UniqueKey] == uuid {
+		delete(m.unique, t.UniqueKey)
+	}
+
+	return nil
+}
+
+func (m *MemoryBackend) SetTaskOwner(uuid, ownerId string) error {
+	m.mu.Lock()
+	m.owners[uuid] = ownerId
+	m.mu.Unlock()
+
+	return nil
+}
+
+// records the lease deadline of a task in the processing list
+func (m *MemoryBackend) SetLease(uuid, processing string, deadline time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	set := leaseSet(processing)
+	if m.leases[set] == nil {
+		m.leases[set] = map[string]time.Time{}
+	}
+	m.leases[set][uuid] = deadline
+
+	return nil
+}
+
+// moves the lease deadline, unless the lease has been already taken away
+func (m *MemoryBackend) RenewLease(uuid, processing string, deadline time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.leases[leaseSet(processing)][uuid]; ok {
+		m.leases[leaseSet(processing)][uuid] = deadline
+	}
+
+	return nil
+}
+
+// returns all the uuids in a list
+func (m *MemoryBackend) GetListTasks(list string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]string{}, m.lists[list]...), nil
+}
+
+// returns result of a finished task, ErrResultNotReady if there is none yet
+func (m *MemoryBackend) GetResult(uuid string) (*TaskResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result, ok := m.results[uuid]
+	if !ok {
+		return nil, ErrResultNotReady
+	}
+
+	return result, nil
+}
@@ -0,0 +1,164 @@
+package redisq
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryBackend_Worker(t *testing.T) {
+	failure := make(chan error, 0)
+	backend := NewMemoryBackend("dummy")
+
+	uuid, err := backend.EnqueueTask([]string{"a", "b"}, &EnqueueOptions{StoreResult: true, UniqueKey: "ab"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if duplicate, err := backend.EnqueueTask([]string{"a", "b"}, &EnqueueOptions{UniqueKey: "ab"}); err != ErrDuplicateTask || duplicate != uuid {
+		t.Fatalf("Expected the pending task %s to be returned with ErrDuplicateTask, got %s, %+v", uuid, duplicate, err)
+	}
+
+	var handled []string
+	handler := WorkerHandler(func(logger Logger, args []string) error {
+		handled = args
+		return nil
+	})
+
+	w := NewBackendWorker(1, backend, handler, failure)
+	picked, err := w.pickTask()
+	if err != nil || picked != uuid {
+		t.Fatalf("Expected task %s to be picked, got %s, %+v", uuid, picked, err)
+	}
+
+	w.processTask(picked)
+
+	if len(handled) != 2 || handled[0] != "a" || handled[1] != "b" {
+		t.Errorf("Handler is expected to be called with the task arguments, got %+v", handled)
+	}
+
+	if result, err := backend.GetResult(uuid); err != nil || result.Error != "" {
+		t.Errorf("Task result is expected to be stored, got %+v, %+v", result, err)
+	}
+
+	if _, err := backend.GetTaskDetails(uuid); err == nil {
+		t.Error("Task is expected to be deleted")
+	}
+
+	if processing, _ := backend.GetListTasks(LIST_PROCESSING); len(processing) != 0 {
+		t.Errorf("Processing list is expected to be empty, got %+v", processing)
+	}
+
+	if _, err := backend.EnqueueTask([]string{"a", "b"}, &EnqueueOptions{UniqueKey: "ab"}); err != nil {
+		t.Errorf("Unique key is expected to be released, got %+v", err)
+	}
+}
+
+func TestMemoryBackend_FinishTask_Lost(t *testing.T) {
+	backend := NewMemoryBackend("dummy")
+
+	uuid, err := backend.EnqueueTask([]string{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the task is still queued, so it cannot be finished
+	if err := backend.FinishTask(uuid, &Transition{Processing: LIST_PROCESSING}); err != ErrTaskLost {
+		t.Errorf("Expected %+v, got %+v", ErrTaskLost, err)
+	}
+
+	if _, err := backend.GetTaskDetails(uuid); err != nil {
+		t.Errorf("Task is not expected to be deleted, got %+v", err)
+	}
+}
+
+func TestMemoryBackend_PickTaskTimeout(t *testing.T) {
+	backend := NewMemoryBackend("dummy")
+
+	if uuid, err := backend.PickTaskTimeout(LIST_QUEUE, LIST_PROCESSING, 10*time.Millisecond); err != nil || uuid != "" {
+		t.Fatalf("Expected no task to be picked, got %s, %+v", uuid, err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		backend.PushTaskToList("pushed", LIST_QUEUE)
+	}()
+
+	start := time.Now()
+	uuid, err := backend.PickTaskTimeout(LIST_QUEUE, LIST_PROCESSING, time.Second)
+	if err != nil || uuid != "pushed" {
+		t.Fatalf("Expected the pushed task to be picked, got %s, %+v", uuid, err)
+	}
+
+	if time.Since(start) >= time.Second {
+		t.Error("Pick is expected to return as soon as a task is pushed")
+	}
+}
+
+func TestMemoryBackend_Retry(t *testing.T) {
+	failure := make(chan error, 0)
+	backend := NewMemoryBackend("dummy")
+
+	uuid, err := backend.EnqueueTask([]string{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := WorkerHandler(func(logger Logger, args []string) error {
+		return errors.New("handler failed")
+	})
+
+	w := NewBackendWorker(1, backend, handler, failure)
+	w.RetryPolicy = &FixedBackoff{Delay: 20 * time.Millisecond}
+
+	picked, _ := w.pickTask()
+	w.processTask(picked)
+
+	if queued, _ := backend.PickTaskFromLists([]string{LIST_QUEUE}, LIST_PROCESSING); queued != "" {
+		t.Fatal("Retry is not expected to be queued before it is due")
+	}
+
+	picked, err = backend.PickTaskTimeout(LIST_QUEUE, LIST_PROCESSING, time.Second)
+	if err != nil || picked != uuid {
+		t.Fatalf("Expected the retry to be picked once due, got %s, %+v", picked, err)
+	}
+
+	taskDetails, err := backend.GetTaskDetails(uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if taskDetails.Attempts != 1 {
+		t.Errorf("Expected 1 attempt to be recorded, got %d", taskDetails.Attempts)
+	}
+}
+
+func TestMemoryBackend_LapsedLease(t *testing.T) {
+	backend := NewMemoryBackend("dummy")
+
+	uuid, err := backend.EnqueueTask([]string{}, &EnqueueOptions{Priority: PRIORITY_HIGH})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	high := priorityList(LIST_QUEUE, PRIORITY_HIGH)
+	if picked, err := backend.PickTaskFromLists([]string{high}, LIST_PROCESSING); err != nil || picked != uuid {
+		t.Fatalf("Expected task %s to be picked, got %s, %+v", uuid, picked, err)
+	}
+
+	backend.SetTaskOwner(uuid, "owner")
+	backend.SetLease(uuid, LIST_PROCESSING, time.Now().Add(-time.Second))
+
+	// the lapsed task is returned to its queue and picked again
+	if picked, err := backend.PickTaskFromLists([]string{high}, LIST_PROCESSING); err != nil || picked != uuid {
+		t.Fatalf("Expected task %s to be picked again, got %s, %+v", uuid, picked, err)
+	}
+
+	if err := backend.FinishTask(uuid, &Transition{Processing: LIST_PROCESSING}); err != nil {
+		t.Fatal(err)
+	}
+
+	if processing, _ := backend.GetListTasks(LIST_PROCESSING); len(processing) != 0 {
+		t.Errorf("Expected the processing list to be empty, got %+v", processing)
+	}
+}
@@ -0,0 +1,39 @@
+package redisq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Defines a handler of tasks with a structured payload of type T
+// (see EnqueueOptions.Payload), tasks without payload get the zero value
+type HandlerFunc[T any] func(logger Logger, payload T) error
+
+// decodes the task payload and calls the handler
+func (h HandlerFunc[T]) HandleTask(logger Logger, taskDetails *TaskDetails) error {
+	var payload T
+
+	if len(taskDetails.Payload) > 0 {
+		if err := json.Unmarshal(taskDetails.Payload, &payload); err != nil {
+			return fmt.Errorf("Decoding task payload failed: %+v", err)
+		}
+	}
+
+	return h(logger, payload)
+}
+
+// Defines a handler of tasks with a structured payload of type T that can be cancelled
+type ContextHandlerFunc[T any] func(ctx context.Context, logger Logger, payload T) error
+
+// decodes the task payload and calls the handler
+func (h ContextHandlerFunc[T]) HandleTaskContext(ctx context.Context, logger Logger, taskDetails *TaskDetails) error {
+	return HandlerFunc[T](func(logger Logger, payload T) error {
+		return h(ctx, logger, payload)
+	}).HandleTask(logger, taskDetails)
+}
+
+// decodes the task payload and calls the handler with a context without deadline
+func (h ContextHandlerFunc[T]) HandleTask(logger Logger, taskDetails *TaskDetails) error {
+	return h.HandleTaskContext(context.Background(), logger, taskDetails)
+}
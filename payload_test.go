@@ -0,0 +1,55 @@
+package redisq
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+type payloadTestArgs struct {
+	UserId int    `json:"userId"`
+	Reason string `json:"reason"`
+}
+
+func TestHandlerFunc_HandleTask(t *testing.T) {
+	var got payloadTestArgs
+	handler := HandlerFunc[payloadTestArgs](func(logger Logger, payload payloadTestArgs) error {
+		got = payload
+		return nil
+	})
+
+	expected := payloadTestArgs{UserId: 42, Reason: "reindex"}
+	payload, err := json.Marshal(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	td := getClientTaskDetails()
+	td.Payload = payload
+
+	if err := handler.HandleTask(&NullLogger{}, td); err != nil {
+		t.Fatal(err)
+	}
+
+	if got != expected {
+		t.Errorf("Payload does not match, expected %+v, got %+v", expected, got)
+	}
+
+	td.Payload = json.RawMessage(`{"userId":"not a number"}`)
+	if err := handler.HandleTask(&NullLogger{}, td); err == nil {
+		t.Error("HandleTask() is expected to fail on an invalid payload")
+	}
+}
+
+func TestRedisClient_prepareTask_Payload(t *testing.T) {
+	client := NewRedisClient(nil, CLIENT_REDIS_PREFIX, CLIENT_TASK_TYPE)
+
+	task, err := client.prepareTask(nil, &EnqueueOptions{Payload: payloadTestArgs{UserId: 42}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"userId":42,"reason":""}`
+	if string(task.details.Payload) != expected {
+		t.Errorf("Unexpected payload, expected %s, got %s", expected, task.details.Payload)
+	}
+}
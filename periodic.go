@@ -0,0 +1,170 @@
+package redisq
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/robfig/cron/v3"
+	"time"
+)
+
+// prefix of the keys that make sure every periodic task occurrence is enqueued once
+const QUEUE_PERIODIC = "periodic"
+
+// how long an occurrence lock is kept (must exceed clock skew between daemons)
+const PERIODIC_LOCK_TTL = time.Hour
+
+// Task that is enqueued by Daemon according to a cron expression
+type PeriodicTask struct {
+	Name      string
+	Spec      string
+	Location  *time.Location
+	Arguments []string
+	schedule  cron.Schedule
+	next      time.Time
+}
+
+// registers a task enqueued by the daemon according to the standard (5 fields)
+// cron expression in the given timezone (local, if nil),
+// the name must be unique within the task type as it identifies the task across daemons
+func (d *Daemon) AddPeriodicTask(name, spec string, location *time.Location, args []string) error {
+	for _, task := range d.periodicTasks {
+		if task.Name == name {
+			return fmt.Errorf("Periodic task \"%s\" is already registered", name)
+		}
+	}
+
+	if location == nil {
+		location = time.Local
+	}
+
+	schedule, err := cron.ParseStandard(fmt.Sprintf("CRON_TZ=%s %s", location.String(), spec))
+	if err != nil {
+		return err
+	}
+
+	d.periodicTasks = append(d.periodicTasks, &PeriodicTask{
+		Name:      name,
+		Spec:      spec,
+		Location:  location,
+		Arguments: args,
+		schedule:  schedule,
+	})
+
+	return nil
+}
+
+// redis key of the lock of a given periodic task occurrence
+func (rc *RedisClient) periodicLockKey(name string, occurrence time.Time) string {
+	return fmt.Sprintf("%s:%s:%s:%s:%d", rc.prefix, QUEUE_PERIODIC, rc.typeKey(), name, occurrence.Unix())
+}
+
+// tries to lock a periodic task occurrence, returns false if it is already locked
+func (rc *RedisClient) LockPeriodicTask(name string, occurrence time.Time, ttl time.Duration) (bool, error) {
+	result, err := redis.String(rc.conn.Do(
+		"SET",
+		rc.periodicLockKey(name, occurrence),
+		1,
+		"NX",
+		"PX",
+		int64(ttl/time.Millisecond),
+	))
+
+	if err == redis.ErrNil {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return result == "OK", nil
+}
+
+// releases a periodic task occurrence lock
+func (rc *RedisClient) UnlockPeriodicTask(name string, occurrence time.Time) error {
+	_, err := rc.conn.Do("DEL", rc.periodicLockKey(name, occurrence))
+
+	return err
+}
+
+// enqueues periodic tasks on their schedule
+func (d *Daemon) runPeriodic() {
+	logger := WrapLogger(d.Logger, fmt.Sprintf("[%s][%s] ", "p", d.taskType))
+	logger.Debug("started")
+
+	now := time.Now()
+	for _, task := range d.periodicTasks {
+		task.next = task.schedule.Next(now)
+	}
+
+	for {
+		conn, err := d.getRedisConn()
+		if conn == nil && err == nil {
+			return
+		}
+
+		if err == nil {
+			err = d.enqueuePeriodicTasks(d.newRedisClient(conn), logger)
+			conn.Close()
+		}
+
+		if err == nil {
+			logger.Debug("stopped")
+			return
+		}
+
+		logger.Errorf("Periodic tasks runner failed with error: %+v", err)
+		d.sleep(5, 15)
+	}
+}
+
+// returns nil once the daemon is stopping
+func (d *Daemon) enqueuePeriodicTasks(rc *RedisClient, logger Logger) error {
+	for {
+		now := time.Now()
+		for _, task := range d.periodicTasks {
+			if now.Before(task.next) {
+				continue
+			}
+
+			if err := d.enqueuePeriodicTask(rc, logger, task); err != nil {
+				return err
+			}
+
+			task.next = task.schedule.Next(now)
+		}
+
+		if !d.wait(time.Duration(d.SchedulerInterval) * time.Millisecond) {
+			return nil
+		}
+	}
+}
+
+func (d *Daemon) enqueuePeriodicTask(rc *RedisClient, logger Logger, task *PeriodicTask) error {
+	locked, err := rc.LockPeriodicTask(task.Name, task.next, PERIODIC_LOCK_TTL)
+	if err != nil {
+		return err
+	}
+
+	// another daemon has already enqueued this occurrence
+	if !locked {
+		logger.Debugf("Periodic task %s at %s is locked by another daemon", task.Name, task.next)
+		return nil
+	}
+
+	enqueue := rc.EnqueueTask
+	if d.Backend == BACKEND_STREAMS {
+		enqueue = rc.EnqueueStreamTask
+	}
+
+	uuid, err := enqueue(task.Arguments, nil)
+	if err != nil {
+		// let another daemon try
+		rc.UnlockPeriodicTask(task.Name, task.next)
+		return err
+	}
+
+	logger.Debugf("Periodic task %s at %s enqueued as %s", task.Name, task.next, uuid)
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package redisq
+
+import (
+	"fmt"
+	"github.com/rafaeljusto/redigomock"
+	"testing"
+	"time"
+)
+
+func TestDaemon_AddPeriodicTask(t *testing.T) {
+	d := NewDaemon(CLIENT_TASK_TYPE, 1, CLIENT_REDIS_PREFIX, "")
+
+	if err := d.AddPeriodicTask("nightly", "0 3 * * *", time.UTC, []string{"foo"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.AddPeriodicTask("nightly", "0 4 * * *", time.UTC, nil); err == nil {
+		t.Error("AddPeriodicTask() is expected to reject a duplicate name")
+	}
+
+	if err := d.AddPeriodicTask("broken", "not a cron", nil, nil); err == nil {
+		t.Error("AddPeriodicTask() is expected to reject an invalid expression")
+	}
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	expected := time.Date(2020, 1, 2, 3, 0, 0, 0, time.UTC)
+	if got := d.periodicTasks[0].schedule.Next(now); !got.Equal(expected) {
+		t.Errorf("Unexpected next occurrence, expected %s, got %s", expected, got)
+	}
+}
+
+func TestRedisClient_LockPeriodicTask(t *testing.T) {
+	occurrence := time.Unix(1500000000, 0)
+	key := fmt.Sprintf("%s:%s:%s:%s:%d", CLIENT_REDIS_PREFIX, QUEUE_PERIODIC, CLIENT_TASK_TYPE, "nightly", occurrence.Unix())
+
+	conn := redigomock.NewConn()
+	conn.Command("SET", key, 1, "NX", "PX", int64(60000)).Expect("OK").Expect(nil)
+
+	client := getRedisClient(conn)
+
+	locked, err := client.LockPeriodicTask("nightly", occurrence, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Error("The first LockPeriodicTask() call is expected to succeed")
+	}
+
+	locked, err = client.LockPeriodicTask("nightly", occurrence, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked {
+		t.Error("The second LockPeriodicTask() call is expected to fail")
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
@@ -0,0 +1,121 @@
+package redisq
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"math/rand"
+)
+
+const (
+	PRIORITY_HIGH   = "high"
+	PRIORITY_NORMAL = "normal"
+	PRIORITY_LOW    = "low"
+)
+
+// all priorities, the most urgent first
+var priorities = []string{PRIORITY_HIGH, PRIORITY_NORMAL, PRIORITY_LOW}
+
+func isValidPriority(priority string) bool {
+	if priority == "" {
+		return true
+	}
+
+	for _, p := range priorities {
+		if p == priority {
+			return true
+		}
+	}
+
+	return false
+}
+
+// name of the list (or set) holding tasks of a given priority,
+// normal priority tasks use the list itself so that older producers keep working
+func priorityList(list, priority string) string {
+	switch priority {
+	case PRIORITY_HIGH, PRIORITY_LOW:
+		return list + "_" + priority
+	default:
+		return list
+	}
+}
+
+// Defines the order in which Worker checks the priority queues
+type PriorityStrategy interface {
+	// priorities in the order they should be checked for the next pick
+	Order() []string
+}
+
+// Always picks the most urgent task available
+type StrictPriority struct{}
+
+func (s *StrictPriority) Order() []string {
+	return priorities
+}
+
+// Picks from a queue with a probability proportional to its weight,
+// so that less urgent tasks do not starve (priorities without weight are checked last)
+type WeightedPriority struct {
+	Weights map[string]int
+}
+
+func (s *WeightedPriority) Order() []string {
+	order := make([]string, 0, len(priorities))
+	remaining := make([]string, 0, len(priorities))
+	total := 0
+	for _, p := range priorities {
+		if s.Weights[p] > 0 {
+			remaining = append(remaining, p)
+			total += s.Weights[p]
+		}
+	}
+
+	for len(remaining) > 0 {
+		n := rand.Intn(total)
+		for i, p := range remaining {
+			if n < s.Weights[p] {
+				order = append(order, p)
+				total -= s.Weights[p]
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+			n -= s.Weights[p]
+		}
+	}
+
+	for _, p := range priorities {
+		if s.Weights[p] <= 0 {
+			order = append(order, p)
+		}
+	}
+
+	return order
+}
+
+// moves a task from the first non-empty list (KEYS[1..n-1]) to KEYS[n]
+var pickFromListsScript = redis.NewScript(-1, `
+for i = 1, #KEYS - 1 do
+	local uuid = redis.call("RPOPLPUSH", KEYS[i], KEYS[#KEYS])
+	if uuid then
+		return uuid
+	end
+end
+return false
+`)
+
+// pick an item from the first non-empty list without blocking,
+// returns an empty string if all the lists are empty
+func (rc *RedisClient) PickTaskFromLists(from []string, to string) (string, error) {
+	keys := make([]interface{}, 0, len(from)+2)
+	keys = append(keys, len(from)+1)
+	for _, list := range from {
+		keys = append(keys, rc.listKey(list))
+	}
+	keys = append(keys, rc.listKey(to))
+
+	uuid, err := redis.String(pickFromListsScript.Do(rc.conn, keys...))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+
+	return uuid, err
+}
@@ -0,0 +1,103 @@
+package redisq
+
+import (
+	"fmt"
+	"github.com/rafaeljusto/redigomock"
+	"sort"
+	"testing"
+)
+
+func TestPriorityList(t *testing.T) {
+	cases := map[string]string{
+		"":              LIST_QUEUE,
+		PRIORITY_NORMAL: LIST_QUEUE,
+		PRIORITY_HIGH:   LIST_QUEUE + "_high",
+		PRIORITY_LOW:    LIST_QUEUE + "_low",
+	}
+
+	for priority, expected := range cases {
+		if got := priorityList(LIST_QUEUE, priority); got != expected {
+			t.Errorf("Unexpected list for priority %q, expected %s, got %s", priority, expected, got)
+		}
+	}
+}
+
+func TestWeightedPriority_Order(t *testing.T) {
+	s := &WeightedPriority{Weights: map[string]int{PRIORITY_HIGH: 5, PRIORITY_NORMAL: 3}}
+
+	for i := 0; i < 100; i++ {
+		order := s.Order()
+
+		if order[2] != PRIORITY_LOW {
+			t.Fatalf("Priority without weight is expected to be checked last, got %+v", order)
+		}
+
+		sorted := append([]string{}, order...)
+		sort.Strings(sorted)
+		if len(sorted) != 3 || sorted[0] != PRIORITY_HIGH || sorted[1] != PRIORITY_LOW || sorted[2] != PRIORITY_NORMAL {
+			t.Fatalf("Every priority is expected exactly once, got %+v", order)
+		}
+	}
+}
+
+func TestRedisClient_PickTaskFromLists(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.GenericCommand("EVALSHA").Expect([]byte(CLIENT_TASK_UUID)).Expect(nil)
+
+	client := getRedisClient(conn)
+
+	uuid, err := client.PickTaskFromLists([]string{"high", "low"}, "to")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uuid != CLIENT_TASK_UUID {
+		t.Errorf("Expected %+v got %+v", CLIENT_TASK_UUID, uuid)
+	}
+
+	uuid, err = client.PickTaskFromLists([]string{"high", "low"}, "to")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uuid != "" {
+		t.Errorf("Expected no task, got %+v", uuid)
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestWorker_PickTask_BlocksWhenEmpty(t *testing.T) {
+	conn := redigomock.NewConn()
+	// promote, then pick from the priority queues
+	conn.GenericCommand("EVALSHA").Expect(int64(0)).Expect(nil)
+	conn.Command("BRPOPLPUSH",
+		fmt.Sprintf("%s:%s:%s", WORKER_REDIS_PREFIX, LIST_QUEUE, WORKER_TASK_TYPE),
+		fmt.Sprintf("%s:%s:%s", WORKER_REDIS_PREFIX, LIST_PROCESSING, WORKER_TASK_TYPE),
+		int64(2),
+	).Expect([]byte(CLIENT_TASK_UUID))
+
+	w := NewWorker(1, conn, WORKER_REDIS_PREFIX, WORKER_TASK_TYPE, nil, make(chan error))
+	w.PollTime = 2000
+
+	uuid, err := w.pickTask()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uuid != CLIENT_TASK_UUID {
+		t.Errorf("Expected the task of the normal queue to be picked, got %+v", uuid)
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestRedisClient_EnqueueTask_InvalidPriority(t *testing.T) {
+	conn := redigomock.NewConn()
+
+	client := getRedisClient(conn)
+	if _, err := client.EnqueueTask(nil, &EnqueueOptions{Priority: "urgent"}); err == nil {
+		t.Error("EnqueueTask() is expected to reject an unknown priority")
+	}
+}
@@ -0,0 +1,424 @@
+package redisq
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"os"
+	"time"
+)
+
+const (
+	// hash of the owners (daemon ids) of the tasks in the processing lists
+	HASH_OWNERS     = "owners"
+	QUEUE_HEARTBEAT = "heartbeat"
+)
+
+// how long the daemon heartbeat lives, if not configured
+const DEFAULT_HEARTBEAT_TTL = 30 * time.Second
+
+// moves an orphaned task from the processing list back to a queue (storing its details ARGV[3], if not empty),
+// unless its owner has changed or is alive (checked unless ARGV[4] is "1"),
+// a task without an owner is left alone while its lease (in KEYS[6]) lasts past ARGV[5],
+// the lease is dropped along with the owner, so that the requeued task is not taken for a lapsed one
+var requeueOrphanScript = redis.NewScript(6, `
+local owner = redis.call("HGET", KEYS[2], ARGV[1])
+if (owner or "") ~= ARGV[2] then
+	return 0
+end
+if owner and ARGV[4] ~= "1" and redis.call("EXISTS", KEYS[4]) == 1 then
+	return 0
+end
+if not owner then
+	local deadline = redis.call("ZSCORE", KEYS[6], ARGV[1])
+	if deadline and tonumber(deadline) > tonumber(ARGV[5]) then
+		return 0
+	end
+end
+if redis.call("LREM", KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+redis.call("HDEL", KEYS[2], ARGV[1])
+redis.call("ZREM", KEYS[6], ARGV[1])
+if ARGV[3] ~= "" then
+	redis.call("SET", KEYS[5], ARGV[3])
+end
+redis.call("LPUSH", KEYS[3], ARGV[1])
+return 1
+`)
+
+// generates a unique id of the current process
+func newOwnerId() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	suffix, err := newUUID()
+	if err != nil {
+		suffix = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+
+	return fmt.Sprintf("%s:%d:%s", hostname, os.Getpid(), suffix[:8])
+}
+
+// redis key showing that an owner is alive
+func (rc *RedisClient) heartbeatKey(ownerId string) string {
+	return fmt.Sprintf("%s:%s:%s:%s", rc.prefix, QUEUE_HEARTBEAT, rc.typeKey(), ownerId)
+}
+
+// marks the owner as alive for ttl
+func (rc *RedisClient) Heartbeat(ownerId string, ttl time.Duration) error {
+	if ttl < time.Millisecond {
+		return fmt.Errorf("Invalid heartbeat TTL %s", ttl)
+	}
+
+	_, err := rc.conn.Do("SET", rc.heartbeatKey(ownerId), 1, "PX", int64(ttl/time.Millisecond))
+
+	return err
+}
+
+// marks the owner as dead at once
+func (rc *RedisClient) ClearHeartbeat(ownerId string) error {
+	_, err := rc.conn.Do("DEL", rc.heartbeatKey(ownerId))
+
+	return err
+}
+
+// checks whether the owner heartbeat has not expired
+func (rc *RedisClient) IsOwnerAlive(ownerId string) (bool, error) {
+	return redis.Bool(rc.conn.Do("EXISTS", rc.heartbeatKey(ownerId)))
+}
+
+// records which owner processes the task
+func (rc *RedisClient) SetTaskOwner(uuid, ownerId string) error {
+	_, err := rc.conn.Do("HSET", rc.listKey(HASH_OWNERS), uuid, ownerId)
+
+	return err
+}
+
+// returns owner of the task, an empty string if there is none
+func (rc *RedisClient) GetTaskOwner(uuid string) (string, error) {
+	owner, err := redis.String(rc.conn.Do("HGET", rc.listKey(HASH_OWNERS), uuid))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+
+	return owner, err
+}
+
+// returns all the uuids in a list
+func (rc *RedisClient) GetListTasks(list string) ([]string, error) {
+	return redis.Strings(rc.conn.Do("LRANGE", rc.listKey(list), 0, -1))
+}
+
+// atomically moves a task from the processing list to the target list (saving its details, if not nil),
+// if it is still owned by the given (dead) owner, returns false otherwise
+// With an empty owner the task must have no owner and no live lease
+func (rc *RedisClient) RequeueOrphanedTask(uuid, ownerId, processing, to string, taskDetails *TaskDetails) (bool, error) {
+	return rc.requeueOwnedTask(uuid, ownerId, processing, to, taskDetails, false)
+}
+
+// as RequeueOrphanedTask, but the owner may be alive, if forced
+func (rc *RedisClient) requeueOwnedTask(uuid, ownerId, processing, to string, taskDetails *TaskDetails, force bool) (bool, error) {
+	var details []byte
+	if taskDetails != nil {
+		var err error
+		if details, err = rc.Codec.Marshal(taskDetails); err != nil {
+			return false, err
+		}
+	}
+
+	forced := ""
+	if force {
+		forced = "1"
+	}
+
+	return redis.Bool(requeueOrphanScript.Do(
+		rc.conn,
+		rc.listKey(processing),
+		rc.listKey(HASH_OWNERS),
+		rc.listKey(to),
+		rc.heartbeatKey(ownerId),
+		rc.taskKey(uuid),
+		rc.listKey(leaseSet(processing)),
+		uuid,
+		ownerId,
+		details,
+		forced,
+		timeToScore(time.Now()),
+	))
+}
+
+// keeps the daemon heartbeat alive, so that its tasks are not reaped,
+// until its handlers cannot touch their tasks any more (see Shutdown)
+func (d *Daemon) runHeartbeat() {
+	logger := WrapLogger(d.Logger, fmt.Sprintf("[%s][%s] ", "h", d.taskType))
+	logger.Debug("started")
+	ttl := d.heartbeatTTL()
+
+	for {
+		err := d.beat(ttl)
+		if err == nil {
+			logger.Debug("stopped")
+			return
+		}
+
+		logger.Errorf("Heartbeat failed with error: %+v", err)
+		// retry before the heartbeat expires, even if the daemon is stopping
+		if !waitFor(ttl/3, d.drained) {
+			return
+		}
+	}
+}
+
+// refreshes the heartbeat until the daemon is drained, then clears it
+func (d *Daemon) beat(ttl time.Duration) error {
+	conn, err := d.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	rc := d.newRedisClient(conn)
+	for {
+		if err := rc.Heartbeat(d.id, ttl); err != nil {
+			return err
+		}
+
+		if !waitFor(ttl/3, d.drained) {
+			// the daemon owns no tasks any more
+			return rc.ClearHeartbeat(d.id)
+		}
+	}
+}
+
+// requeues tasks left in the processing lists by dead daemons or with lapsed leases
+func (d *Daemon) runReaper() {
+	logger := WrapLogger(d.Logger, fmt.Sprintf("[%s][%s] ", "r", d.taskType))
+	logger.Debug("started")
+
+	// tasks without a live owner and when they were first seen as such
+	// (the owner may have not recorded itself or sent the first heartbeat yet)
+	suspects := map[string]time.Time{}
+
+	for {
+		conn, err := d.getRedisConn()
+		if conn == nil && err == nil {
+			return
+		}
+
+		if err == nil {
+			err = d.reap(d.newRedisClient(conn), logger, suspects)
+			conn.Close()
+		}
+
+		if err == nil {
+			logger.Debug("stopped")
+			return
+		}
+
+		logger.Errorf("Reaper failed with error: %+v", err)
+		d.sleep(5, 15)
+	}
+}
+
+// returns nil once the daemon is stopping
+func (d *Daemon) reap(rc *RedisClient, logger Logger, suspects map[string]time.Time) error {
+	for {
+		if err := d.reapOrphanedTasks(rc, logger, suspects); err != nil {
+			return err
+		}
+
+		if err := d.requeueLapsedTasks(rc, logger); err != nil {
+			return err
+		}
+
+		if !d.wait(time.Duration(d.ReaperInterval) * time.Millisecond) {
+			return nil
+		}
+	}
+}
+
+func (d *Daemon) heartbeatTTL() time.Duration {
+	if d.HeartbeatTTL <= 0 {
+		return DEFAULT_HEARTBEAT_TTL
+	}
+
+	return time.Duration(d.HeartbeatTTL) * time.Millisecond
+}
+
+// Tasks without an owner are requeued after the grace period as well, unless they hold a live lease
+// (a worker may have died between picking a task and recording itself as its owner),
+// so a Worker without OwnerId sharing the queues with a Daemon must set VisibilityTimeout
+func (d *Daemon) reapOrphanedTasks(rc *RedisClient, logger Logger, suspects map[string]time.Time) error {
+	grace := d.heartbeatTTL()
+	seen := map[string]bool{}
+
+	for _, processing := range []string{LIST_PROCESSING, LIST_FAILURE_PROCESSING} {
+		uuids, err := rc.GetListTasks(processing)
+		if err != nil {
+			return err
+		}
+
+		for _, uuid := range uuids {
+			seen[uuid] = true
+
+			owner, err := rc.GetTaskOwner(uuid)
+			if err != nil {
+				return err
+			}
+
+			if owner != "" {
+				alive, err := rc.IsOwnerAlive(owner)
+				if err != nil {
+					return err
+				}
+				if alive {
+					delete(suspects, uuid)
+					continue
+				}
+			}
+
+			if _, ok := suspects[uuid]; !ok {
+				suspects[uuid] = time.Now()
+			}
+			if time.Since(suspects[uuid]) < grace {
+				continue
+			}
+
+			if err := d.requeueOrphanedTask(rc, logger, uuid, owner, processing); err != nil {
+				return err
+			}
+			delete(suspects, uuid)
+		}
+	}
+
+	for uuid := range suspects {
+		if !seen[uuid] {
+			delete(suspects, uuid)
+		}
+	}
+
+	return nil
+}
+
+func (d *Daemon) requeueOrphanedTask(rc *RedisClient, logger Logger, uuid, owner, processing string) error {
+	taskDetails, err := rc.GetTaskDetails(uuid)
+	if err != nil {
+		logger.Errorf("GetTaskDetails(\"%s\") call failed: %+v", uuid, err)
+		taskDetails = nil
+	}
+
+	// failure worker decides on its own whether a failed task is retried
+	to := LIST_FAILURE
+	if processing == LIST_PROCESSING && taskDetails != nil && taskDetails.Attempts+1 < d.FailureMaxAttempts {
+		to = priorityList(LIST_QUEUE, taskDetails.Priority)
+	}
+
+	if taskDetails != nil {
+		// count the attempt that was interrupted
+		taskDetails.NewAttempt()
+		taskDetails.LastError = fmt.Sprintf("Owner \"%s\" died while processing the task", owner)
+		if owner == "" {
+			taskDetails.LastError = "Task has been left without an owner"
+		}
+	}
+
+	moved, err := rc.RequeueOrphanedTask(uuid, owner, processing, to, taskDetails)
+	if err != nil || !moved {
+		return err
+	}
+
+	logger.Infof("Task %s of dead owner \"%s\" moved from %s to %s", uuid, owner, processing, to)
+
+	return nil
+}
+
+// returns the tasks still owned by the (stopping) daemon to their queues
+// (or lets the other consumers claim its pending stream entries), returns amount of requeued tasks
+// The heartbeat is still alive meanwhile, so that the reaper does not requeue the tasks as well
+func (d *Daemon) requeueOwnedTasks() (int, error) {
+	conn, err := d.dial()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	rc := d.newRedisClient(conn)
+
+	n := 0
+	if d.Backend == BACKEND_STREAMS {
+		if n, err = d.releaseStreamTasks(rc); err != nil {
+			return n, err
+		}
+	}
+
+	for _, processing := range []string{LIST_PROCESSING, LIST_FAILURE_PROCESSING} {
+		uuids, err := rc.GetListTasks(processing)
+		if err != nil {
+			return n, err
+		}
+
+		for _, uuid := range uuids {
+			owner, err := rc.GetTaskOwner(uuid)
+			if err != nil {
+				return n, err
+			}
+			if owner != d.id {
+				continue
+			}
+
+			to := LIST_FAILURE
+			if processing == LIST_PROCESSING {
+				to = LIST_QUEUE
+				if taskDetails, err := rc.GetTaskDetails(uuid); err == nil {
+					to = priorityList(LIST_QUEUE, taskDetails.Priority)
+				}
+			}
+
+			moved, err := rc.requeueOwnedTask(uuid, owner, processing, to, nil, true)
+			if err != nil {
+				return n, err
+			}
+
+			if moved {
+				d.Logger.Infof("Unfinished task %s moved from %s to %s", uuid, processing, to)
+				n++
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// how long the pending stream entries stay with the daemon (see StreamWorker.ClaimIdle)
+func (d *Daemon) claimIdle() time.Duration {
+	if d.VisibilityTimeout <= 0 {
+		return DEFAULT_CLAIM_IDLE
+	}
+
+	return time.Duration(d.VisibilityTimeout) * time.Millisecond
+}
+
+// makes the stream entries still pending for the daemon claimable at once, returns amount of released entries
+func (d *Daemon) releaseStreamTasks(rc *RedisClient) (int, error) {
+	pending, err := rc.ConsumerPendingStreamTasks(d.id, DEFAULT_PROMOTE_BATCH_SIZE)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, entry := range pending {
+		released, err := rc.SetStreamTaskIdle(entry.ID, d.id, d.claimIdle())
+		if err != nil {
+			return n, err
+		}
+
+		if released {
+			d.Logger.Infof("Unfinished stream entry %s released", entry.ID)
+			n++
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,139 @@
+package redisq
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"testing"
+	"time"
+)
+
+func TestDaemon_reapOrphanedTasks(t *testing.T) {
+	jsonTaskDetails, err := json.Marshal(getClientTaskDetails())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := redigomock.NewConn()
+	conn.Command("LRANGE", fmt.Sprintf("%s:%s:%s", CLIENT_REDIS_PREFIX, LIST_PROCESSING, CLIENT_TASK_TYPE), 0, -1).
+		Expect([]interface{}{[]byte(CLIENT_TASK_UUID)})
+	conn.Command("LRANGE", fmt.Sprintf("%s:%s:%s", CLIENT_REDIS_PREFIX, LIST_FAILURE_PROCESSING, CLIENT_TASK_TYPE), 0, -1).
+		Expect([]interface{}{})
+	conn.Command("HGET", fmt.Sprintf("%s:%s:%s", CLIENT_REDIS_PREFIX, HASH_OWNERS, CLIENT_TASK_TYPE), CLIENT_TASK_UUID).
+		Expect([]byte("dead_owner"))
+	conn.Command("EXISTS", fmt.Sprintf("%s:%s:%s:%s", CLIENT_REDIS_PREFIX, QUEUE_HEARTBEAT, CLIENT_TASK_TYPE, "dead_owner")).
+		Expect(int64(0))
+	conn.Command("GET", fmt.Sprintf("%s:%s:%s:%s", CLIENT_REDIS_PREFIX, QUEUE_TASK, CLIENT_TASK_TYPE, CLIENT_TASK_UUID)).
+		Expect(jsonTaskDetails)
+	requeue := conn.GenericCommand("EVALSHA").Expect(int64(1))
+	save := conn.GenericCommand("SET")
+
+	d := NewDaemon(CLIENT_TASK_TYPE, 1, CLIENT_REDIS_PREFIX, "")
+	rc := getRedisClient(conn)
+	suspects := map[string]time.Time{}
+
+	// the owner may have just started, so the task is not reaped immediately
+	if err := d.reapOrphanedTasks(rc, d.Logger, suspects); err != nil {
+		t.Fatal(err)
+	}
+	if conn.Stats(requeue) != 0 {
+		t.Fatal("Task is not expected to be requeued before the grace period")
+	}
+
+	suspects[CLIENT_TASK_UUID] = time.Now().Add(-time.Hour)
+	if err := d.reapOrphanedTasks(rc, d.Logger, suspects); err != nil {
+		t.Fatal(err)
+	}
+	if conn.Stats(requeue) != 1 {
+		t.Error("Orphaned task is expected to be requeued")
+	}
+	if conn.Stats(save) != 0 {
+		t.Error("Task details are expected to be saved by the requeue script")
+	}
+	if len(suspects) != 0 {
+		t.Errorf("Requeued task is expected to be forgotten, got %+v", suspects)
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestDaemon_reapOrphanedTasks_Ownerless(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("LRANGE", fmt.Sprintf("%s:%s:%s", CLIENT_REDIS_PREFIX, LIST_PROCESSING, CLIENT_TASK_TYPE), 0, -1).
+		Expect([]interface{}{[]byte(CLIENT_TASK_UUID)})
+	conn.Command("LRANGE", fmt.Sprintf("%s:%s:%s", CLIENT_REDIS_PREFIX, LIST_FAILURE_PROCESSING, CLIENT_TASK_TYPE), 0, -1).
+		Expect([]interface{}{})
+	conn.Command("HGET", fmt.Sprintf("%s:%s:%s", CLIENT_REDIS_PREFIX, HASH_OWNERS, CLIENT_TASK_TYPE), CLIENT_TASK_UUID).
+		Expect(nil)
+	conn.GenericCommand("GET").ExpectError(redis.ErrNil)
+	requeue := conn.GenericCommand("EVALSHA").Expect(int64(1))
+
+	d := NewDaemon(CLIENT_TASK_TYPE, 1, CLIENT_REDIS_PREFIX, "")
+	rc := getRedisClient(conn)
+	suspects := map[string]time.Time{}
+
+	// the worker may be recording itself as the owner right now
+	if err := d.reapOrphanedTasks(rc, d.Logger, suspects); err != nil {
+		t.Fatal(err)
+	}
+	if conn.Stats(requeue) != 0 {
+		t.Fatal("Task without an owner is not expected to be requeued before the grace period")
+	}
+
+	// the worker died between picking the task and recording itself as the owner
+	suspects[CLIENT_TASK_UUID] = time.Now().Add(-time.Hour)
+	if err := d.reapOrphanedTasks(rc, d.Logger, suspects); err != nil {
+		t.Fatal(err)
+	}
+	if conn.Stats(requeue) != 1 {
+		t.Error("Task left without an owner is expected to be requeued after the grace period")
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestRedisClient_Heartbeat_InvalidTTL(t *testing.T) {
+	conn := redigomock.NewConn()
+
+	client := getRedisClient(conn)
+	if err := client.Heartbeat("owner", 0); err == nil {
+		t.Error("Heartbeat() is expected to reject a zero TTL")
+	}
+}
+
+// records the arguments of the last script call
+type scriptConn struct {
+	*redigomock.Conn
+	args []interface{}
+}
+
+func (c *scriptConn) Do(command string, args ...interface{}) (interface{}, error) {
+	if command == "EVALSHA" {
+		c.args = args
+	}
+
+	return c.Conn.Do(command, args...)
+}
+
+func TestRedisClient_RequeueOrphanedTask_Lease(t *testing.T) {
+	mock := redigomock.NewConn()
+	mock.GenericCommand("EVALSHA").Expect(int64(1))
+	conn := &scriptConn{Conn: mock}
+
+	client := NewRedisClient(conn, CLIENT_REDIS_PREFIX, CLIENT_TASK_TYPE)
+	moved, err := client.RequeueOrphanedTask(CLIENT_TASK_UUID, "dead_owner", LIST_PROCESSING, LIST_QUEUE, nil)
+	if err != nil || !moved {
+		t.Fatalf("Expected the task to be requeued, got %t, %+v", moved, err)
+	}
+
+	// the script removes the task from the lease set as well (hash, number of keys, keys)
+	lease := fmt.Sprintf("%s:%s:%s", CLIENT_REDIS_PREFIX, leaseSet(LIST_PROCESSING), CLIENT_TASK_TYPE)
+	if len(conn.args) < 8 || conn.args[1] != 6 || conn.args[7] != lease {
+		t.Errorf("Expected the lease set %s to be passed to the requeue script, got %+v", lease, conn.args)
+	}
+}
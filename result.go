@@ -0,0 +1,135 @@
+package redisq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+const (
+	QUEUE_RESULT = "result"
+	QUEUE_NOTIFY = "notify"
+)
+
+// how long results are kept, if not configured
+const DEFAULT_RESULT_TTL = 24 * time.Hour
+
+// Returned by GetResult when the task has not finished yet (or its result has expired)
+var ErrResultNotReady = errors.New("Task result is not ready")
+
+// Outcome of a task enqueued with EnqueueOptions.StoreResult
+type TaskResult struct {
+	// json encoded value returned by a ResultTaskHandler (null for other handlers)
+	Result json.RawMessage `json:"result,omitempty"`
+	// set if the task has failed permanently
+	Error string `json:"error,omitempty"`
+}
+
+// decodes the result into v, returns the task error if the task has failed
+func (r *TaskResult) Decode(v interface{}) error {
+	if r.Error != "" {
+		return errors.New(r.Error)
+	}
+
+	if len(r.Result) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(r.Result, v)
+}
+
+// Handler that returns a result (stored if the task was enqueued with EnqueueOptions.StoreResult)
+type ResultTaskHandler interface {
+	TaskHandler
+	HandleTaskResult(logger Logger, taskDetails *TaskDetails) (interface{}, error)
+}
+
+// Defines a handler of tasks with a payload of type T returning a result of type R
+type ResultHandlerFunc[T, R any] func(logger Logger, payload T) (R, error)
+
+// decodes the task payload and calls the handler, returns its result
+func (h ResultHandlerFunc[T, R]) HandleTaskResult(logger Logger, taskDetails *TaskDetails) (interface{}, error) {
+	var result R
+	err := HandlerFunc[T](func(logger Logger, payload T) error {
+		var err error
+		result, err = h(logger, payload)
+		return err
+	}).HandleTask(logger, taskDetails)
+
+	return result, err
+}
+
+// decodes the task payload and calls the handler, the result is dropped
+func (h ResultHandlerFunc[T, R]) HandleTask(logger Logger, taskDetails *TaskDetails) error {
+	_, err := h.HandleTaskResult(logger, taskDetails)
+
+	return err
+}
+
+// redis key of a task result
+func (rc *RedisClient) resultKey(uuid string) string {
+	return fmt.Sprintf("%s:%s:%s:%s", rc.prefix, QUEUE_RESULT, rc.typeKey(), uuid)
+}
+
+// redis key of a list that receives an item once a task result is stored
+func (rc *RedisClient) notifyKey(uuid string) string {
+	return fmt.Sprintf("%s:%s:%s:%s", rc.prefix, QUEUE_NOTIFY, rc.typeKey(), uuid)
+}
+
+// returns the result of a finished task or ErrResultNotReady
+func (rc *RedisClient) GetResult(uuid string) (*TaskResult, error) {
+	data, err := redis.Bytes(rc.conn.Do("GET", rc.resultKey(uuid)))
+	if err == redis.ErrNil {
+		return nil, ErrResultNotReady
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var result TaskResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// how often AwaitResult checks for the result in the last second before the deadline
+const awaitPollInterval = 50 * time.Millisecond
+
+// waits for the task result until the context is done
+// (the connection is blocked meanwhile, so use a dedicated one)
+func (rc *RedisClient) AwaitResult(ctx context.Context, uuid string) (*TaskResult, error) {
+	for {
+		result, err := rc.GetResult(uuid)
+		if err != ErrResultNotReady {
+			return result, err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// BLPOP timeouts are whole seconds, so poll the result close to the deadline instead
+		// (it is checked once more when the deadline is reached)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < time.Second {
+			timer := time.NewTimer(awaitPollInterval)
+			select {
+			case <-ctx.Done():
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		}
+
+		// wake up every second to check the context
+		_, err = rc.conn.Do("BLPOP", rc.notifyKey(uuid), 1)
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package redisq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rafaeljusto/redigomock"
+	"testing"
+	"time"
+)
+
+func TestRedisClient_GetResult(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("GET",
+		fmt.Sprintf("%s:%s:%s:%s", CLIENT_REDIS_PREFIX, QUEUE_RESULT, CLIENT_TASK_TYPE, CLIENT_TASK_UUID),
+	).Expect(nil).Expect([]byte(`{"result":{"count":3}}`))
+
+	client := getRedisClient(conn)
+
+	if _, err := client.GetResult(CLIENT_TASK_UUID); err != ErrResultNotReady {
+		t.Errorf("Expected %+v got %+v", ErrResultNotReady, err)
+	}
+
+	result, err := client.GetResult(CLIENT_TASK_UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var value struct{ Count int }
+	if err := result.Decode(&value); err != nil {
+		t.Fatal(err)
+	}
+	if value.Count != 3 {
+		t.Errorf("Expected %d got %d", 3, value.Count)
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestRedisClient_AwaitResult(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("GET",
+		fmt.Sprintf("%s:%s:%s:%s", CLIENT_REDIS_PREFIX, QUEUE_RESULT, CLIENT_TASK_TYPE, CLIENT_TASK_UUID),
+	).Expect(nil).Expect([]byte(`{"error":"boom"}`))
+	blpop := conn.Command("BLPOP",
+		fmt.Sprintf("%s:%s:%s:%s", CLIENT_REDIS_PREFIX, QUEUE_NOTIFY, CLIENT_TASK_TYPE, CLIENT_TASK_UUID),
+		1,
+	).Expect([]interface{}{[]byte("notify"), []byte("1")})
+
+	client := getRedisClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := client.AwaitResult(ctx, CLIENT_TASK_UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := result.Decode(nil); err == nil || err.Error() != "boom" {
+		t.Errorf("Expected the task error, got %+v", err)
+	}
+
+	if conn.Stats(blpop) != 1 {
+		t.Error("AwaitResult() is expected to block on the notify list")
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestRedisClient_AwaitResult_Deadline(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("GET",
+		fmt.Sprintf("%s:%s:%s:%s", CLIENT_REDIS_PREFIX, QUEUE_RESULT, CLIENT_TASK_TYPE, CLIENT_TASK_UUID),
+	).Expect(nil)
+
+	client := getRedisClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := client.AwaitResult(ctx, CLIENT_TASK_UUID); err != context.DeadlineExceeded {
+		t.Errorf("Expected %+v, got %+v", context.DeadlineExceeded, err)
+	}
+
+	if time.Since(start) >= time.Second {
+		t.Error("AwaitResult() is not expected to block past the context deadline")
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestRedisClient_AwaitResult_ShortDeadline(t *testing.T) {
+	conn := redigomock.NewConn()
+	// the result is stored soon after the call
+	conn.Command("GET",
+		fmt.Sprintf("%s:%s:%s:%s", CLIENT_REDIS_PREFIX, QUEUE_RESULT, CLIENT_TASK_TYPE, CLIENT_TASK_UUID),
+	).Expect(nil).Expect([]byte(`{}`))
+
+	client := getRedisClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 900*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := client.AwaitResult(ctx, CLIENT_TASK_UUID); err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(start) >= 500*time.Millisecond {
+		t.Errorf("AwaitResult() is expected to return the result before the deadline, took %s", time.Since(start))
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestWorker_processTask_Expired_StoreResult(t *testing.T) {
+	failure := make(chan error, 0)
+
+	taskDetails := getWorkerTaskDetails()
+	taskDetails.StoreResult = true
+	taskDetails.ExpiresAt = "2000-01-01T00:00:00Z"
+	jsonTaskDetails, err := json.Marshal(taskDetails)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := redigomock.NewConn()
+	conn.Command(
+		"GET",
+		fmt.Sprintf("%s:%s:%s:%s", WORKER_REDIS_PREFIX, QUEUE_TASK, WORKER_TASK_TYPE, WORKER_TASK_UUID),
+	).Expect([]byte(jsonTaskDetails))
+	expired := expectFinishTask(conn, LIST_PROCESSING, LIST_EXPIRED, nil, []byte(`{"error":"Task expired at 2000-01-01T00:00:00Z"}`), "")
+
+	w := NewWorker(1, conn, WORKER_REDIS_PREFIX, WORKER_TASK_TYPE, nil, failure)
+	w.processTask(WORKER_TASK_UUID)
+
+	if conn.Stats(expired) != 1 {
+		t.Error("Expired task is expected to store an error result")
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestWorker_processTask_StoreResult(t *testing.T) {
+	failure := make(chan error, 0)
+
+	taskDetails := getWorkerTaskDetails()
+	taskDetails.StoreResult = true
+	taskDetails.Payload = json.RawMessage(`2`)
+	jsonTaskDetails, err := json.Marshal(taskDetails)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := redigomock.NewConn()
+	conn.Command(
+		"GET",
+		fmt.Sprintf("%s:%s:%s:%s", WORKER_REDIS_PREFIX, QUEUE_TASK, WORKER_TASK_TYPE, WORKER_TASK_UUID),
+	).Expect([]byte(jsonTaskDetails))
+	conn.GenericCommand("SET")
+	finish := expectFinishTask(conn, LIST_PROCESSING, "", nil, []byte(`{"result":4}`), "")
+
+	handler := ResultHandlerFunc[int, int](func(logger Logger, payload int) (int, error) {
+		return payload * 2, nil
+	})
+
+	w := NewTaskWorker(1, conn, WORKER_REDIS_PREFIX, WORKER_TASK_TYPE, handler, failure)
+	w.processTask(WORKER_TASK_UUID)
+
+	if conn.Stats(finish) != 1 {
+		t.Error("Task is expected to be deleted along with storing its result")
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
@@ -0,0 +1,110 @@
+package redisq
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// sorted set of failed tasks waiting for a retry, scored by the time (unix ms) they are due at
+// (there is one per priority, see priorityList; due tasks are moved to the queue by the scheduler)
+const ZSET_RETRY = "retry"
+
+// Defines how long to wait before retrying a failed task
+type RetryPolicy interface {
+	// delay before the next attempt of a task that has failed the given number of attempts
+	NextDelay(attempts int) time.Duration
+}
+
+// Custom retry policy
+type RetryPolicyFunc func(attempts int) time.Duration
+
+func (f RetryPolicyFunc) NextDelay(attempts int) time.Duration {
+	return f(attempts)
+}
+
+// Waits the same time before every retry
+type FixedBackoff struct {
+	Delay time.Duration
+}
+
+func (b *FixedBackoff) NextDelay(attempts int) time.Duration {
+	return b.Delay
+}
+
+// Waits Initial + Step * (attempts - 1), but not longer than Max (if set)
+type LinearBackoff struct {
+	Initial time.Duration
+	Step    time.Duration
+	Max     time.Duration
+}
+
+func (b *LinearBackoff) NextDelay(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	return capDelay(b.Initial+b.Step*time.Duration(attempts-1), b.Max)
+}
+
+// Waits Initial * Multiplier ^ (attempts - 1), but not longer than Max (if set),
+// reduced by a random part of up to Jitter (0..1) of the delay
+type ExponentialBackoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+func (b *ExponentialBackoff) NextDelay(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	multiplier := b.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+
+	delay := float64(b.Initial) * math.Pow(multiplier, float64(attempts-1))
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+
+	if b.Jitter > 0 {
+		delay -= delay * math.Min(b.Jitter, 1) * rand.Float64()
+	}
+
+	return time.Duration(delay)
+}
+
+func capDelay(delay, max time.Duration) time.Duration {
+	if max > 0 && delay > max {
+		return max
+	}
+
+	return delay
+}
+
+// the task own retry policy, if registered, the default one otherwise
+func (w *Worker) retryPolicy(taskDetails *TaskDetails) RetryPolicy {
+	if taskDetails.RetryPolicy != "" {
+		if policy, ok := w.RetryPolicies[taskDetails.RetryPolicy]; ok {
+			return policy
+		}
+		w.Logger.Warnf("Retry policy \"%s\" is not registered, using the default one", taskDetails.RetryPolicy)
+	}
+
+	return w.RetryPolicy
+}
+
+// parks a failed task in the retry set until the policy delay passes
+func (w *Worker) retryTransition(uuid string, taskDetails *TaskDetails, policy RetryPolicy) *Transition {
+	delay := policy.NextDelay(taskDetails.Attempts)
+	w.Logger.Debugf("Retrying %s in %s", uuid, delay)
+
+	return &Transition{
+		To:    priorityList(ZSET_RETRY, taskDetails.Priority),
+		RunAt: time.Now().Add(delay),
+	}
+}
@@ -0,0 +1,92 @@
+package redisq
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicies_NextDelay(t *testing.T) {
+	cases := []struct {
+		name     string
+		policy   RetryPolicy
+		attempts int
+		expected time.Duration
+	}{
+		{"fixed", &FixedBackoff{Delay: time.Second}, 3, time.Second},
+		{"linear", &LinearBackoff{Initial: time.Second, Step: 2 * time.Second}, 3, 5 * time.Second},
+		{"linear capped", &LinearBackoff{Initial: time.Second, Step: 2 * time.Second, Max: 4 * time.Second}, 3, 4 * time.Second},
+		{"exponential", &ExponentialBackoff{Initial: time.Second}, 4, 8 * time.Second},
+		{"exponential capped", &ExponentialBackoff{Initial: time.Second, Multiplier: 3, Max: time.Minute}, 10, time.Minute},
+		{"custom", RetryPolicyFunc(func(attempts int) time.Duration { return time.Duration(attempts) * time.Hour }), 2, 2 * time.Hour},
+	}
+
+	for _, c := range cases {
+		if got := c.policy.NextDelay(c.attempts); got != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, got)
+		}
+	}
+}
+
+func TestExponentialBackoff_Jitter(t *testing.T) {
+	policy := &ExponentialBackoff{Initial: time.Second, Jitter: 0.5}
+
+	for i := 0; i < 100; i++ {
+		got := policy.NextDelay(2)
+		if got < time.Second || got > 2*time.Second {
+			t.Fatalf("Delay is expected to be within [1s, 2s], got %s", got)
+		}
+	}
+}
+
+func TestFailureWorker_processTask_RetryPolicy(t *testing.T) {
+	failure := make(chan error, 0)
+	conn := getFailureRedisConnMock(t)
+	schedule := conn.GenericCommand("EVALSHA")
+
+	w := NewFailureWorker(1, conn, FAILURE_WORKER_REDIS_PREFIX, FAILURE_WORKER_TASK_TYPE, nil, failure)
+	w.SleepTime = 60000
+	w.RetryPolicy = &FixedBackoff{Delay: time.Hour}
+	w.RetryPolicies = map[string]RetryPolicy{"slow": &FixedBackoff{Delay: 24 * time.Hour}}
+
+	start := time.Now()
+	w.processTask(FAILURE_WORKER_TASK_UUID)
+
+	if time.Since(start) > time.Second {
+		t.Error("Failure worker is not expected to sleep when retries are scheduled")
+	}
+
+	if conn.Stats(schedule) != 1 {
+		t.Error("Task is expected to be scheduled for a retry")
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+
+	if policy := w.retryPolicy(&TaskDetails{RetryPolicy: "slow"}); policy != w.RetryPolicies["slow"] {
+		t.Error("Task retry policy is expected to override the default one")
+	}
+}
+
+func TestWorker_processTask_RetryPolicy(t *testing.T) {
+	failure := make(chan error, 0)
+	conn := getRedisConnMock(t)
+	retry := conn.GenericCommand("EVALSHA")
+
+	handler := WorkerHandler(func(logger Logger, args []string) error {
+		return errors.New("handler failed")
+	})
+
+	w := NewWorker(1, conn, WORKER_REDIS_PREFIX, WORKER_TASK_TYPE, handler, failure)
+	w.RetryPolicy = &FixedBackoff{Delay: time.Hour}
+	w.processTask(WORKER_TASK_UUID)
+
+	if conn.Stats(retry) != 1 {
+		t.Error("Failed task is expected to be parked in the retry set")
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
@@ -0,0 +1,94 @@
+package redisq
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// sorted set of delayed tasks, scored by the time (unix ms) they must run at
+// (there is one per priority, see priorityList)
+const ZSET_SCHEDULED = "scheduled"
+
+// default amount of due tasks moved to the queue at once
+const DEFAULT_PROMOTE_BATCH_SIZE = 100
+
+// moves up to ARGV[2] tasks in total scored not later than ARGV[1] from the schedules
+// to their queues (or adds them to the queue streams, if ARGV[3] is "1"),
+// keys are (schedule, queue) pairs in the order they are emptied
+var promoteScript = redis.NewScript(-1, `
+local moved = 0
+for i = 1, #KEYS, 2 do
+	if moved >= tonumber(ARGV[2]) then
+		break
+	end
+	local uuids = redis.call("ZRANGEBYSCORE", KEYS[i], "-inf", ARGV[1], "LIMIT", 0, tonumber(ARGV[2]) - moved)
+	for _, uuid in ipairs(uuids) do
+		redis.call("ZREM", KEYS[i], uuid)
+		if ARGV[3] == "1" then
+			redis.call("XADD", KEYS[i + 1], "*", "uuid", uuid)
+		else
+			redis.call("LPUSH", KEYS[i + 1], uuid)
+		end
+	end
+	moved = moved + #uuids
+end
+return moved
+`)
+
+// converts time to a sorted set score
+func timeToScore(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// creates a new task that is put to the queue not earlier than runAt,
+// returns uuid of the created task
+func (rc *RedisClient) ScheduleTask(args []string, runAt time.Time, opts *EnqueueOptions) (string, error) {
+	task, err := rc.prepareTask(args, opts)
+	if err != nil {
+		return "", err
+	}
+
+	task.runAt = runAt
+
+	return rc.storeTask(task)
+}
+
+// creates a new task that is put to the queue after the delay
+func (rc *RedisClient) DelayTask(args []string, delay time.Duration, opts *EnqueueOptions) (string, error) {
+	return rc.ScheduleTask(args, time.Now().Add(delay), opts)
+}
+
+// atomically moves up to limit tasks (in total, the most urgent priority first) due at the given time
+// from the schedule and retry sets to the queues, returns amount of moved tasks
+func (rc *RedisClient) PromoteScheduledTasks(now time.Time, limit int) (int, error) {
+	return rc.promoteScheduledTasks(now, limit, false)
+}
+
+// moves the due tasks to the queues, or to the tasks stream (if stream is set)
+func (rc *RedisClient) promoteScheduledTasks(now time.Time, limit int, stream bool) (int, error) {
+	if limit <= 0 {
+		limit = DEFAULT_PROMOTE_BATCH_SIZE
+	}
+
+	// delayed retries are promoted the same way as scheduled tasks
+	keysAndArgs := make([]interface{}, 0, len(priorities)*4+4)
+	keysAndArgs = append(keysAndArgs, len(priorities)*4)
+	for _, priority := range priorities {
+		queue := rc.listKey(priorityList(LIST_QUEUE, priority))
+		if stream {
+			queue = rc.listKey(STREAM_TASKS)
+		}
+
+		for _, set := range []string{ZSET_SCHEDULED, ZSET_RETRY} {
+			keysAndArgs = append(keysAndArgs, rc.listKey(priorityList(set, priority)), queue)
+		}
+	}
+
+	xadd := ""
+	if stream {
+		xadd = "1"
+	}
+	keysAndArgs = append(keysAndArgs, timeToScore(now), limit, xadd)
+
+	return redis.Int(promoteScript.Do(rc.conn, keysAndArgs...))
+}
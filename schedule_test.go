@@ -0,0 +1,49 @@
+package redisq
+
+import (
+	"github.com/rafaeljusto/redigomock"
+	"testing"
+	"time"
+)
+
+func TestRedisClient_ScheduleTask(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.GenericCommand("EVALSHA").Expect([]byte(CLIENT_TASK_UUID))
+
+	client := getRedisClient(conn)
+	uuid, err := client.ScheduleTask([]string{"foo"}, time.Now().Add(time.Hour), &EnqueueOptions{UUID: CLIENT_TASK_UUID})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uuid != CLIENT_TASK_UUID {
+		t.Errorf("Expected %+v got %+v", CLIENT_TASK_UUID, uuid)
+		t.FailNow()
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestRedisClient_PromoteScheduledTasks(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.GenericCommand("EVALSHA").Expect(int64(3))
+
+	client := getRedisClient(conn)
+	n, err := client.PromoteScheduledTasks(time.Now(), 10)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 3 {
+		t.Errorf("Expected %d promoted tasks, got %d", 3, n)
+		t.FailNow()
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
@@ -0,0 +1,254 @@
+package redisq
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net"
+	"strings"
+	"sync"
+)
+
+// channel Sentinel announces failovers on
+const SENTINEL_SWITCH_MASTER = "+switch-master"
+
+// Connects to the current master of a group monitored by Redis Sentinel (see Daemon.Sentinel)
+// Connections are closed on failover, so that the workers reconnect to the new master
+type Sentinel struct {
+	// name of the monitored master
+	MasterName string
+	// addresses of the sentinels, the responsive one is moved to the front
+	Addrs []string
+	// used to connect to the master
+	DialOptions *DialOptions
+	// used to connect to the sentinels (no timeouts, if nil; the read timeout must be zero for Watch)
+	SentinelDialOptions *DialOptions
+	Logger              Logger
+	mu                  sync.Mutex
+	// last known master address
+	master string
+	// connections to the master that are not closed yet (created on the first Dial)
+	conns map[*sentinelConn]bool
+}
+
+func (s *Sentinel) logger() Logger {
+	if s.Logger == nil {
+		return &NullLogger{}
+	}
+
+	return s.Logger
+}
+
+// Instantiates Sentinel class
+// In addition it is possible to set exported parameters (DialOptions, SentinelDialOptions, Logger)
+func NewSentinel(masterName string, addrs []string) *Sentinel {
+	return &Sentinel{
+		MasterName: masterName,
+		Addrs:      addrs,
+		Logger:     &NullLogger{},
+		conns:      map[*sentinelConn]bool{},
+	}
+}
+
+// connection to the master, forgotten by Sentinel once closed
+type sentinelConn struct {
+	redis.Conn
+	sentinel *Sentinel
+	once     sync.Once
+}
+
+func (c *sentinelConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.sentinel.mu.Lock()
+		delete(c.sentinel.conns, c)
+		c.sentinel.mu.Unlock()
+		err = c.Conn.Close()
+	})
+
+	return err
+}
+
+// asks a sentinel for the master address
+func queryMasterAddr(conn redis.Conn, masterName string) (string, error) {
+	reply, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", masterName))
+	if err == redis.ErrNil {
+		return "", fmt.Errorf("Master \"%s\" is unknown to the sentinel", masterName)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if len(reply) != 2 {
+		return "", errors.New("Unexpected reply to SENTINEL get-master-addr-by-name")
+	}
+
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+// connects to the first responsive sentinel
+func (s *Sentinel) dialSentinel() (redis.Conn, error) {
+	s.mu.Lock()
+	addrs := append([]string{}, s.Addrs...)
+	s.mu.Unlock()
+
+	err := errors.New("No sentinel addresses")
+	for i, addr := range addrs {
+		var conn redis.Conn
+		if conn, err = s.SentinelDialOptions.Dial(addr); err != nil {
+			s.logger().Warnf("Cannot connect to sentinel %s: %+v", addr, err)
+			continue
+		}
+
+		// prefer the responsive sentinel next time
+		if i > 0 {
+			s.mu.Lock()
+			s.Addrs = append([]string{addr}, append(addrs[:i:i], addrs[i+1:]...)...)
+			s.mu.Unlock()
+		}
+
+		return conn, nil
+	}
+
+	return nil, err
+}
+
+// discovers the current master address
+func (s *Sentinel) MasterAddr() (string, error) {
+	conn, err := s.dialSentinel()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	addr, err := queryMasterAddr(conn, s.MasterName)
+	if err != nil {
+		return "", err
+	}
+
+	s.switchMaster(addr)
+
+	return addr, nil
+}
+
+// connects to the current master (a DialFunc, see Daemon.Dial)
+func (s *Sentinel) Dial() (redis.Conn, error) {
+	addr, err := s.MasterAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := s.DialOptions.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the sentinels may not have noticed the failover yet
+	role, err := redis.Values(conn.Do("ROLE"))
+	if err == nil && (len(role) == 0 || fmt.Sprintf("%s", role[0]) != "master") {
+		err = fmt.Errorf("Redis at %s is not a master", addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := &sentinelConn{Conn: conn, sentinel: s}
+	s.mu.Lock()
+	// the Sentinel may be instantiated without NewSentinel
+	if s.conns == nil {
+		s.conns = map[*sentinelConn]bool{}
+	}
+	s.conns[c] = true
+	s.mu.Unlock()
+
+	return c, nil
+}
+
+// remembers the master address, closes the connections to the previous master
+func (s *Sentinel) switchMaster(addr string) {
+	s.mu.Lock()
+	previous := s.master
+	s.master = addr
+
+	var conns []*sentinelConn
+	if previous != "" && previous != addr {
+		for c := range s.conns {
+			conns = append(conns, c)
+		}
+	}
+	s.mu.Unlock()
+
+	if previous == "" || previous == addr {
+		return
+	}
+
+	s.logger().Warnf("Master \"%s\" failed over from %s to %s, closing %d connections", s.MasterName, previous, addr, len(conns))
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// handles a "+switch-master" message: <master name> <old ip> <old port> <new ip> <new port>
+func (s *Sentinel) handleSwitchMaster(message string) {
+	fields := strings.Fields(message)
+	if len(fields) != 5 || fields[0] != s.MasterName {
+		return
+	}
+
+	s.switchMaster(net.JoinHostPort(fields[3], fields[4]))
+}
+
+// follows the failovers announced by a sentinel until stop is closed (returns nil then)
+func (s *Sentinel) Watch(stop <-chan struct{}) error {
+	conn, err := s.dialSentinel()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(SENTINEL_SWITCH_MASTER); err != nil {
+		return err
+	}
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			s.handleSwitchMaster(string(v.Data))
+		case error:
+			select {
+			case <-stop:
+				return nil
+			default:
+				return v
+			}
+		}
+	}
+}
+
+// watches the sentinel failovers until the daemon stops
+func (d *Daemon) runSentinel() {
+	logger := WrapLogger(d.Logger, fmt.Sprintf("[%s][%s] ", "sentinel", d.taskType))
+	logger.Debug("started")
+
+	for {
+		err := d.Sentinel.Watch(d.stopping)
+		if err == nil || d.stopped() {
+			logger.Debug("stopped")
+			return
+		}
+
+		logger.Errorf("Watching sentinel failed with error: %+v", err)
+		d.sleep(1, 5)
+	}
+}
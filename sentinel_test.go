@@ -0,0 +1,129 @@
+package redisq
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/rafaeljusto/redigomock"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestQueryMasterAddr(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("SENTINEL", "get-master-addr-by-name", "mymaster").
+		Expect([]interface{}{[]byte("10.0.0.1"), []byte("6379")})
+
+	addr, err := queryMasterAddr(conn, "mymaster")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr != "10.0.0.1:6379" {
+		t.Errorf("Expected %+v got %+v", "10.0.0.1:6379", addr)
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestSentinel_handleSwitchMaster(t *testing.T) {
+	s := NewSentinel("mymaster", []string{"10.0.0.10:26379"})
+	s.switchMaster("10.0.0.1:6379")
+
+	closed := 0
+	conn := redigomock.NewConn()
+	conn.CloseMock = func() error {
+		closed++
+		return nil
+	}
+	s.conns[&sentinelConn{Conn: conn, sentinel: s}] = true
+
+	// failover of another master
+	s.handleSwitchMaster("othermaster 10.0.0.3 6379 10.0.0.4 6379")
+	if closed != 0 {
+		t.Fatal("Connections are not expected to be closed on failover of another master")
+	}
+
+	s.handleSwitchMaster("mymaster 10.0.0.1 6379 10.0.0.2 6379")
+	if closed != 1 || len(s.conns) != 0 {
+		t.Error("Connections to the previous master are expected to be closed on failover")
+	}
+
+	if s.master != "10.0.0.2:6379" {
+		t.Errorf("Expected master %+v got %+v", "10.0.0.2:6379", s.master)
+	}
+}
+
+// accepts connections and replies to the commands by their names (+OK to the unknown ones),
+// the replies are built for the address of the server
+func serveScriptedRedis(t *testing.T, build func(addr string) map[string]string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	replies := build(listener.Addr().String())
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					command := make([]string, n)
+					for i := range command {
+						r.ReadString('\n')
+						arg, _ := r.ReadString('\n')
+						command[i] = strings.TrimSpace(arg)
+					}
+
+					reply, ok := replies[strings.ToUpper(command[0])]
+					if !ok {
+						reply = "+OK\r\n"
+					}
+					fmt.Fprint(conn, reply)
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestSentinel_Dial_Literal(t *testing.T) {
+	// the same server acts as the sentinel and the master
+	addr := serveScriptedRedis(t, func(addr string) map[string]string {
+		host, port, _ := net.SplitHostPort(addr)
+		return map[string]string{
+			"SENTINEL": fmt.Sprintf("*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port),
+			"ROLE":     "*1\r\n$6\r\nmaster\r\n",
+		}
+	})
+
+	s := &Sentinel{MasterName: "mymaster", Addrs: []string{addr}}
+	conn, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if len(s.conns) != 1 {
+		t.Errorf("Expected the connection to be tracked, got %+v", s.conns)
+	}
+}
@@ -0,0 +1,564 @@
+package redisq
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"time"
+)
+
+const (
+	// stream of the task uuids (the details are kept in the task keys, as with the lists)
+	STREAM_TASKS = "stream"
+	// consumer group of the workers, every Daemon is a consumer
+	STREAM_GROUP = "workers"
+)
+
+// how long a pending task stays with its consumer, if not configured (see StreamWorker.ClaimIdle)
+const DEFAULT_CLAIM_IDLE = 5 * time.Minute
+
+// Daemon backends (see Daemon.Backend)
+const (
+	// tasks are moved between lists (default)
+	BACKEND_LISTS = "lists"
+	// tasks are read from a stream by a consumer group and recovered by claiming pending entries
+	BACKEND_STREAMS = "streams"
+)
+
+// acknowledges and deletes the stream entry of a finished task, then either deletes the task
+// (ARGV[4] is empty) or saves its details (unless ARGV[5] is empty) and pushes it to KEYS[3]
+// (or adds it to the KEYS[3] sorted set scored ARGV[10], if it is not empty),
+// stores the result (unless ARGV[6] is empty) and releases the unique key (if ARGV[8] is "1"),
+// does nothing and returns 0 if the entry is not pending for the ARGV[9] consumer (e.g. it has been claimed)
+var streamFinishScript = redis.NewScript(6, `
+local uuid = ARGV[3]
+local pending = redis.call("XPENDING", KEYS[1], ARGV[1], ARGV[2], ARGV[2], 1)
+if #pending == 0 or pending[1][2] ~= ARGV[9] then
+	return 0
+end
+redis.call("XACK", KEYS[1], ARGV[1], ARGV[2])
+redis.call("XDEL", KEYS[1], ARGV[2])
+if ARGV[4] == "" then
+	redis.call("DEL", KEYS[2])
+else
+	if ARGV[5] ~= "" then
+		redis.call("SET", KEYS[2], ARGV[5])
+	end
+	if ARGV[10] == "" then
+		redis.call("LPUSH", KEYS[3], uuid)
+	else
+		redis.call("ZADD", KEYS[3], ARGV[10], uuid)
+	end
+end
+if ARGV[6] ~= "" then
+	redis.call("SET", KEYS[4], ARGV[6], "PX", ARGV[7])
+	redis.call("LPUSH", KEYS[5], 1)
+	redis.call("PEXPIRE", KEYS[5], ARGV[7])
+end
+if ARGV[8] == "1" and redis.call("GET", KEYS[6]) == uuid then
+	redis.call("DEL", KEYS[6])
+end
+return 1
+`)
+
+// sets idle time (ARGV[4] ms) of the ARGV[2] entry pending for the ARGV[3] consumer,
+// does nothing and returns 0 if the entry is not pending for the consumer anymore
+var streamIdleScript = redis.NewScript(1, `
+local pending = redis.call("XPENDING", KEYS[1], ARGV[1], ARGV[2], ARGV[2], 1)
+if #pending == 0 or pending[1][2] ~= ARGV[3] then
+	return 0
+end
+redis.call("XCLAIM", KEYS[1], ARGV[1], ARGV[3], 0, ARGV[2], "IDLE", ARGV[4], "JUSTID")
+return 1
+`)
+
+// Entry of the tasks stream
+type StreamEntry struct {
+	ID   string
+	UUID string
+}
+
+// Entry delivered to a consumer but not acknowledged yet
+type StreamPending struct {
+	ID         string
+	Consumer   string
+	Idle       time.Duration
+	Deliveries int
+}
+
+// parses an entry reply: [id, [field, value, ...]]
+func parseStreamEntry(reply interface{}) (*StreamEntry, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// the entry may have been deleted while pending
+	if len(values) != 2 || values[1] == nil {
+		return nil, nil
+	}
+
+	id, err := redis.String(values[0], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := redis.StringMap(values[1], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamEntry{ID: id, UUID: fields["uuid"]}, nil
+}
+
+// creates the consumer group (and the stream), unless it exists
+func (rc *RedisClient) CreateStreamGroup() error {
+	_, err := rc.conn.Do("XGROUP", "CREATE", rc.listKey(STREAM_TASKS), STREAM_GROUP, "0", "MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+
+	return err
+}
+
+// creates a new task and adds it to the stream within a single transaction,
+// returns uuid of the created task (priorities, unique keys and scheduling are not supported)
+func (rc *RedisClient) EnqueueStreamTask(args []string, opts *EnqueueOptions) (string, error) {
+	if opts != nil && (opts.UniqueKey != "" || (opts.Priority != "" && opts.Priority != PRIORITY_NORMAL)) {
+		return "", errors.New("Unique keys and priorities are not supported by the streams backend")
+	}
+
+	task, err := rc.prepareTask(args, opts)
+	if err != nil {
+		return "", err
+	}
+
+	rc.conn.Send("MULTI")
+	rc.conn.Send("SET", rc.taskKey(task.uuid), task.data)
+	rc.conn.Send("XADD", rc.listKey(STREAM_TASKS), "*", "uuid", task.uuid)
+	replies, err := redis.Values(rc.conn.Do("EXEC"))
+	if err != nil {
+		return "", err
+	}
+
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return "", err
+		}
+	}
+
+	return task.uuid, nil
+}
+
+// reads a new entry for the consumer, waits up to block for one,
+// returns nil if there is none
+func (rc *RedisClient) ReadStreamTask(consumer string, block time.Duration) (*StreamEntry, error) {
+	reply, err := redis.Values(rc.conn.Do(
+		"XREADGROUP",
+		"GROUP",
+		STREAM_GROUP,
+		consumer,
+		"COUNT",
+		1,
+		"BLOCK",
+		int64(block/time.Millisecond),
+		"STREAMS",
+		rc.listKey(STREAM_TASKS),
+		">",
+	))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// [[stream, [entry]]]
+	for _, stream := range reply {
+		values, err := redis.Values(stream, nil)
+		if err != nil || len(values) != 2 {
+			return nil, errors.New("Unexpected reply to XREADGROUP")
+		}
+
+		entries, err := redis.Values(values[1], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(entries) > 0 {
+			return parseStreamEntry(entries[0])
+		}
+	}
+
+	return nil, nil
+}
+
+// claims an entry idle for at least minIdle for the consumer, scanning the pending entries from start,
+// returns the entry (nil if there is none) and where to continue the scan from
+func (rc *RedisClient) ClaimStreamTask(consumer string, minIdle time.Duration, start string) (*StreamEntry, string, error) {
+	reply, err := redis.Values(rc.conn.Do(
+		"XAUTOCLAIM",
+		rc.listKey(STREAM_TASKS),
+		STREAM_GROUP,
+		consumer,
+		int64(minIdle/time.Millisecond),
+		start,
+		"COUNT",
+		1,
+	))
+	if err != nil {
+		return nil, start, err
+	}
+
+	// [next start, [entry], (deleted ids)]
+	if len(reply) < 2 {
+		return nil, start, errors.New("Unexpected reply to XAUTOCLAIM")
+	}
+
+	next, err := redis.String(reply[0], nil)
+	if err != nil {
+		return nil, start, err
+	}
+
+	entries, err := redis.Values(reply[1], nil)
+	if err != nil || len(entries) == 0 {
+		return nil, next, err
+	}
+
+	entry, err := parseStreamEntry(entries[0])
+
+	return entry, next, err
+}
+
+// sets idle time of an entry pending for the consumer, it is claimed by any consumer once idle for the claim time
+// (zero idle keeps the entry with the consumer, like a lease renewal),
+// returns false if another consumer has claimed the entry meanwhile
+func (rc *RedisClient) SetStreamTaskIdle(id, consumer string, idle time.Duration) (bool, error) {
+	return redis.Bool(streamIdleScript.Do(
+		rc.conn,
+		rc.listKey(STREAM_TASKS),
+		STREAM_GROUP,
+		id,
+		consumer,
+		int64(idle/time.Millisecond),
+	))
+}
+
+// atomically adds up to limit due scheduled tasks and retries to the stream, returns amount of added tasks
+func (rc *RedisClient) PromoteScheduledStreamTasks(now time.Time, limit int) (int, error) {
+	return rc.promoteScheduledTasks(now, limit, true)
+}
+
+// returns up to count entries delivered but not acknowledged yet
+func (rc *RedisClient) PendingStreamTasks(count int) ([]StreamPending, error) {
+	return parseStreamPending(rc.conn.Do("XPENDING", rc.listKey(STREAM_TASKS), STREAM_GROUP, "-", "+", count))
+}
+
+// returns up to count entries delivered to the consumer but not acknowledged yet
+func (rc *RedisClient) ConsumerPendingStreamTasks(consumer string, count int) ([]StreamPending, error) {
+	return parseStreamPending(rc.conn.Do("XPENDING", rc.listKey(STREAM_TASKS), STREAM_GROUP, "-", "+", count, consumer))
+}
+
+// parses an extended XPENDING reply
+func parseStreamPending(reply interface{}, err error) ([]StreamPending, error) {
+	items, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]StreamPending, 0, len(items))
+	for _, item := range items {
+		// [id, consumer, idle ms, deliveries]
+		values, err := redis.Values(item, nil)
+		if err != nil || len(values) != 4 {
+			return nil, errors.New("Unexpected reply to XPENDING")
+		}
+
+		id, _ := redis.String(values[0], nil)
+		consumer, _ := redis.String(values[1], nil)
+		idle, _ := redis.Int64(values[2], nil)
+		deliveries, _ := redis.Int(values[3], nil)
+
+		pending = append(pending, StreamPending{
+			ID:         id,
+			Consumer:   consumer,
+			Idle:       time.Duration(idle) * time.Millisecond,
+			Deliveries: deliveries,
+		})
+	}
+
+	return pending, nil
+}
+
+// atomically acknowledges the entry pending for the consumer and applies the transition,
+// returns ErrTaskLost if another consumer has claimed the entry meanwhile
+func (rc *RedisClient) AckStreamTask(entry *StreamEntry, consumer string, t *Transition) error {
+	push := ""
+	to := STREAM_TASKS
+	if t.To != "" {
+		push = "1"
+		to = t.To
+	}
+
+	details, result, err := rc.encodeTransition(t)
+	if err != nil {
+		return err
+	}
+
+	release := ""
+	if t.UniqueKey != "" {
+		release = "1"
+	}
+
+	score := ""
+	if !t.RunAt.IsZero() {
+		score = fmt.Sprintf("%d", timeToScore(t.RunAt))
+	}
+
+	finished, err := redis.Bool(streamFinishScript.Do(
+		rc.conn,
+		rc.listKey(STREAM_TASKS),
+		rc.taskKey(entry.UUID),
+		rc.listKey(to),
+		rc.resultKey(entry.UUID),
+		rc.notifyKey(entry.UUID),
+		rc.uniqueKey(t.UniqueKey),
+		STREAM_GROUP,
+		entry.ID,
+		entry.UUID,
+		push,
+		details,
+		result,
+		int64(t.ResultTTL/time.Millisecond),
+		release,
+		consumer,
+		score,
+	))
+	if err != nil {
+		return err
+	}
+
+	if !finished {
+		return ErrTaskLost
+	}
+
+	return nil
+}
+
+// Worker reading tasks from the stream as a member of the consumer group
+// Failed tasks stay pending and are claimed again once the retry delay passes,
+// as are the tasks of consumers that died (see ClaimIdle)
+// Retries delayed for ClaimIdle or longer are moved to the retry set and added to the stream again when due,
+// as are the scheduled tasks (by the Daemon scheduler, or the worker itself, see PromoteInterval)
+type StreamWorker struct {
+	Worker
+	// name of the worker in the consumer group
+	Consumer string
+	// ms, pending tasks idle for this time are claimed, the handlers renew their tasks meanwhile
+	ClaimIdle   int
+	claimCursor string
+	rc          *RedisClient
+}
+
+// Instantiates StreamWorker class
+// In addition it is possible to set exported parameters (the Worker ones, Consumer, ClaimIdle)
+// Scheduled tasks and retries are added to the stream by the worker (see PromoteInterval)
+// Failed tasks are retried at once, unless RetryPolicy is set
+func NewStreamWorker(id int, conn redis.Conn, prefix, taskType string, handler TaskHandler, failure chan error) *StreamWorker {
+	rc := NewRedisClient(conn, prefix, taskType)
+	w := newStreamWorker(NewBackendWorker(id, rc, handler, failure), rc, newOwnerId())
+	w.RetryPolicy = &FixedBackoff{}
+
+	return w
+}
+
+// the worker must use the client as its backend
+func newStreamWorker(worker *Worker, rc *RedisClient, consumer string) *StreamWorker {
+	return &StreamWorker{
+		Worker:      *worker,
+		Consumer:    consumer,
+		ClaimIdle:   int(DEFAULT_CLAIM_IDLE / time.Millisecond),
+		claimCursor: "0-0",
+		rc:          rc,
+	}
+}
+
+func (w *StreamWorker) claimIdle() time.Duration {
+	return time.Duration(w.ClaimIdle) * time.Millisecond
+}
+
+// acknowledges the task and applies the transition
+func (w *StreamWorker) finishTask(entry *StreamEntry, t *Transition) error {
+	t.ResultTTL = w.resultTTL()
+
+	if t.To == "" {
+		w.Logger.Debug("Deleting task:", entry.UUID)
+	} else {
+		w.Logger.Debugf("Pushing %s to %s", entry.UUID, t.To)
+	}
+
+	err := w.rc.AckStreamTask(entry, w.Consumer, t)
+	if err == ErrTaskLost {
+		w.Logger.Warnf("Task %s has been claimed by another consumer meanwhile, dropping its transition", entry.UUID)
+		return err
+	}
+
+	if err != nil {
+		w.Logger.Errorf("AckStreamTask(\"%s\", \"%s\") call failed: %+v", entry.ID, t.To, err)
+		return err
+	}
+
+	return nil
+}
+
+// sets idle time of the entry, unless another consumer has claimed it meanwhile
+func (w *StreamWorker) setTaskIdle(entry *StreamEntry, idle time.Duration) {
+	ok, err := w.rc.SetStreamTaskIdle(entry.ID, w.Consumer, idle)
+	if err != nil {
+		w.Logger.Errorf("SetStreamTaskIdle(\"%s\") call failed: %+v", entry.ID, err)
+		return
+	}
+
+	if !ok {
+		w.Logger.Warnf("Task %s has been claimed by another consumer meanwhile", entry.UUID)
+	}
+}
+
+// leaves the task pending, so that it is claimed again after the delay (shorter than the claim time)
+func (w *StreamWorker) retryTask(entry *StreamEntry, taskDetails *TaskDetails, delay time.Duration) {
+	if err := w.backend.SaveTaskDetails(entry.UUID, taskDetails); err != nil {
+		w.Logger.Errorf("SaveTaskDetails(\"%s\") call failed: %+v", entry.UUID, err)
+	}
+
+	idle := w.claimIdle() - delay
+	if idle < 0 {
+		idle = 0
+	}
+
+	w.Logger.Debugf("Retrying %s in %s", entry.UUID, w.claimIdle()-idle)
+	w.setTaskIdle(entry, idle)
+}
+
+func (w *StreamWorker) processTask(entry *StreamEntry) {
+	uuid := entry.UUID
+	w.Logger.Debugf("Processing task id: %s (entry %s)", uuid, entry.ID)
+
+	taskDetails, err := w.backend.GetTaskDetails(uuid)
+	if err != nil {
+		w.Logger.Errorf("GetTaskDetails(\"%s\") call failed: %+v", uuid, err)
+		w.finishTask(entry, w.failureTransition(uuid, err, nil, true))
+		return
+	}
+
+	// do not run a task that is worthless already
+	if taskDetails.IsExpired(time.Now()) {
+		w.finishTask(entry, expiredTransition(taskDetails))
+		return
+	}
+
+	taskDetails.NewAttempt()
+	if err := w.backend.SaveTaskDetails(uuid, taskDetails); err != nil {
+		w.Logger.Errorf("SaveTaskDetails(\"%s\") call failed: %+v", uuid, err)
+		w.finishTask(entry, w.failureTransition(uuid, err, taskDetails, true))
+		return
+	}
+
+	// keep the task from being claimed while the handler runs
+	w.Logger.Debugf("Calling %s handler with args %+v", uuid, taskDetails.Arguments)
+	stopRenewing := w.keepRenewing(w.claimIdle(), func() {
+		w.setTaskIdle(entry, 0)
+	})
+	result, err := w.callHandler(taskDetails)
+	stopRenewing()
+
+	if err == nil {
+		t := &Transition{UniqueKey: taskDetails.UniqueKey}
+		if taskDetails.StoreResult {
+			t.Result = w.encodeResult(uuid, result)
+		}
+		w.finishTask(entry, t)
+		return
+	}
+
+	// the handler was cancelled on shutdown, the attempt does not count and any consumer may claim the task at once
+	if w.interrupted() {
+		w.Logger.Infof("Handler call for task \"%s\" interrupted: %+v", uuid, err)
+		taskDetails.Attempts--
+		w.retryTask(entry, taskDetails, 0)
+		return
+	}
+
+	w.Logger.Errorf("Handler call for task \"%s\" failed: %+v", uuid, err)
+	t := w.failureTransition(uuid, err, taskDetails, isPermanent(err))
+	if delay := time.Until(t.RunAt); !t.RunAt.IsZero() && delay < w.claimIdle() {
+		w.retryTask(entry, taskDetails, delay)
+		return
+	}
+
+	w.finishTask(entry, t)
+}
+
+// reads a new task or claims an idle one, waits until there is one,
+// returns nil if the worker must stop
+func (w *StreamWorker) pickTask() (*StreamEntry, error) {
+	for !w.stopped() {
+		w.promoteWith(w.rc.PromoteScheduledStreamTasks)
+
+		entry, err := w.rc.ReadStreamTask(w.Consumer, DEFAULT_PICK_TIMEOUT)
+		if err != nil || entry != nil {
+			return entry, err
+		}
+
+		entry, w.claimCursor, err = w.rc.ClaimStreamTask(w.Consumer, w.claimIdle(), w.claimCursor)
+		if err != nil || entry != nil {
+			if entry != nil {
+				w.Logger.Infof("Claimed task %s (entry %s)", entry.UUID, entry.ID)
+			}
+			return entry, err
+		}
+	}
+
+	return nil, nil
+}
+
+// Get worker instance id
+func (w *StreamWorker) GetInstanceId() int {
+	return w.id
+}
+
+// Get worker task type
+func (w *StreamWorker) GetTaskType() string {
+	return w.backend.TaskType()
+}
+
+// Run a worker (normally use a goroutine to allow concurrent workers)
+func (w *StreamWorker) Run() {
+	w.Logger.Debug("started")
+
+	err := w.rc.CreateStreamGroup()
+	for err == nil {
+		var entry *StreamEntry
+		entry, err = w.pickTask()
+
+		// the connection may be closed on shutdown
+		if w.stopped() && (err != nil || entry == nil) {
+			w.Logger.Debug("stopped")
+			return
+		}
+
+		if err == nil {
+			w.processTask(entry)
+		}
+	}
+
+	select {
+	case w.failure <- WorkerFatalError{
+		WorkerError: WorkerError{
+			Worker: w,
+			Err:    fmt.Errorf("Reading stream failed: %+v", err),
+		},
+	}:
+	case <-w.stop:
+	}
+}
@@ -0,0 +1,295 @@
+package redisq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"testing"
+	"time"
+)
+
+const STREAM_ENTRY_ID = "1700000000000-0"
+
+func TestRedisClient_ReadStreamTask(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command(
+		"XREADGROUP", "GROUP", STREAM_GROUP, "consumer", "COUNT", 1, "BLOCK", int64(1000),
+		"STREAMS", fmt.Sprintf("%s:%s:%s", CLIENT_REDIS_PREFIX, STREAM_TASKS, CLIENT_TASK_TYPE), ">",
+	).Expect([]interface{}{
+		[]interface{}{
+			[]byte(fmt.Sprintf("%s:%s:%s", CLIENT_REDIS_PREFIX, STREAM_TASKS, CLIENT_TASK_TYPE)),
+			[]interface{}{
+				[]interface{}{[]byte(STREAM_ENTRY_ID), []interface{}{[]byte("uuid"), []byte(CLIENT_TASK_UUID)}},
+			},
+		},
+	})
+
+	client := getRedisClient(conn)
+	entry, err := client.ReadStreamTask("consumer", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry == nil || entry.ID != STREAM_ENTRY_ID || entry.UUID != CLIENT_TASK_UUID {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestRedisClient_PendingStreamTasks(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.Command("XPENDING", fmt.Sprintf("%s:%s:%s", CLIENT_REDIS_PREFIX, STREAM_TASKS, CLIENT_TASK_TYPE), STREAM_GROUP, "-", "+", 10).
+		Expect([]interface{}{
+			[]interface{}{[]byte(STREAM_ENTRY_ID), []byte("consumer"), int64(1500), int64(2)},
+		})
+
+	client := getRedisClient(conn)
+	pending, err := client.PendingStreamTasks(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := StreamPending{ID: STREAM_ENTRY_ID, Consumer: "consumer", Idle: 1500 * time.Millisecond, Deliveries: 2}
+	if len(pending) != 1 || pending[0] != expected {
+		t.Errorf("Expected %+v got %+v", expected, pending)
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestStreamWorker_processTask(t *testing.T) {
+	failure := make(chan error, 0)
+	conn := getRedisConnMock(t)
+
+	key := func(queue, id string) string {
+		return fmt.Sprintf("%s:%s:%s:%s", WORKER_REDIS_PREFIX, queue, WORKER_TASK_TYPE, id)
+	}
+	stream := fmt.Sprintf("%s:%s:%s", WORKER_REDIS_PREFIX, STREAM_TASKS, WORKER_TASK_TYPE)
+	ack := conn.Command(
+		"EVALSHA",
+		streamFinishScript.Hash(),
+		6,
+		stream,
+		key(QUEUE_TASK, WORKER_TASK_UUID),
+		stream,
+		key(QUEUE_RESULT, WORKER_TASK_UUID),
+		key(QUEUE_NOTIFY, WORKER_TASK_UUID),
+		key(QUEUE_UNIQUE, ""),
+		STREAM_GROUP,
+		STREAM_ENTRY_ID,
+		WORKER_TASK_UUID,
+		"",
+		[]byte(nil),
+		[]byte(nil),
+		int64(DEFAULT_RESULT_TTL/time.Millisecond),
+		"",
+		"consumer",
+		"",
+	).Expect(int64(1))
+
+	handler := WorkerHandler(func(logger Logger, args []string) error {
+		return nil
+	})
+
+	w := NewStreamWorker(1, conn, WORKER_REDIS_PREFIX, WORKER_TASK_TYPE, handler, failure)
+	w.Consumer = "consumer"
+	w.processTask(&StreamEntry{ID: STREAM_ENTRY_ID, UUID: WORKER_TASK_UUID})
+
+	if conn.Stats(ack) != 1 {
+		t.Error("Processed task is expected to be acknowledged and deleted")
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestStreamWorker_processTask_Retry(t *testing.T) {
+	failure := make(chan error, 0)
+	conn := getRedisConnMock(t)
+	save := conn.GenericCommand("SET")
+	retry := conn.Command(
+		"EVALSHA",
+		streamIdleScript.Hash(),
+		1,
+		fmt.Sprintf("%s:%s:%s", WORKER_REDIS_PREFIX, STREAM_TASKS, WORKER_TASK_TYPE),
+		STREAM_GROUP,
+		STREAM_ENTRY_ID,
+		"consumer",
+		int64(240000),
+	).Expect(int64(1))
+	ack := conn.GenericCommand("EVALSHA")
+
+	handler := WorkerHandler(func(logger Logger, args []string) error {
+		return errors.New("handler failed")
+	})
+
+	w := NewStreamWorker(1, conn, WORKER_REDIS_PREFIX, WORKER_TASK_TYPE, handler, failure)
+	w.Consumer = "consumer"
+	w.RetryPolicy = &FixedBackoff{Delay: time.Minute}
+	w.processTask(&StreamEntry{ID: STREAM_ENTRY_ID, UUID: WORKER_TASK_UUID})
+
+	if conn.Stats(save) != 1 || conn.Stats(retry) != 1 {
+		t.Error("Failed task is expected to stay pending until the retry delay passes")
+	}
+
+	if conn.Stats(ack) != 0 {
+		t.Error("Failed task is not expected to be acknowledged")
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestRedisClient_AckStreamTask_Lost(t *testing.T) {
+	conn := redigomock.NewConn()
+	// the entry has been claimed by another consumer
+	conn.GenericCommand("EVALSHA").Expect(int64(0))
+
+	client := getRedisClient(conn)
+	err := client.AckStreamTask(&StreamEntry{ID: STREAM_ENTRY_ID, UUID: CLIENT_TASK_UUID}, "consumer", &Transition{})
+	if err != ErrTaskLost {
+		t.Errorf("Expected %+v, got %+v", ErrTaskLost, err)
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestRedisClient_SetStreamTaskIdle_Lost(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.GenericCommand("EVALSHA").Expect(int64(0))
+
+	client := getRedisClient(conn)
+	ok, err := client.SetStreamTaskIdle(STREAM_ENTRY_ID, "consumer", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok {
+		t.Error("Entry claimed by another consumer is not expected to be renewed")
+	}
+}
+
+func TestStreamWorker_processTask_LongRetry(t *testing.T) {
+	failure := make(chan error, 0)
+	conn := getRedisConnMock(t)
+	idle := conn.Command(
+		"EVALSHA",
+		streamIdleScript.Hash(),
+		1,
+		fmt.Sprintf("%s:%s:%s", WORKER_REDIS_PREFIX, STREAM_TASKS, WORKER_TASK_TYPE),
+		STREAM_GROUP,
+		STREAM_ENTRY_ID,
+		"consumer",
+		int64(0),
+	).Expect(int64(1))
+	// acknowledged and parked in the retry set
+	ack := conn.GenericCommand("EVALSHA").Expect(int64(1))
+
+	handler := WorkerHandler(func(logger Logger, args []string) error {
+		return errors.New("handler failed")
+	})
+
+	w := NewStreamWorker(1, conn, WORKER_REDIS_PREFIX, WORKER_TASK_TYPE, handler, failure)
+	w.Consumer = "consumer"
+	w.RetryPolicy = &FixedBackoff{Delay: time.Hour}
+	w.processTask(&StreamEntry{ID: STREAM_ENTRY_ID, UUID: WORKER_TASK_UUID})
+
+	if conn.Stats(ack) != 1 {
+		t.Error("Task retried after the claim time is expected to be moved to the retry set")
+	}
+
+	if conn.Stats(idle) != 0 {
+		t.Error("Task retried after the claim time is not expected to stay pending")
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestStreamWorker_processTask_Interrupted(t *testing.T) {
+	failure := make(chan error, 0)
+	conn := getRedisConnMock(t)
+	conn.GenericCommand("SET")
+	// claimable by any consumer at once
+	release := conn.Command(
+		"EVALSHA",
+		streamIdleScript.Hash(),
+		1,
+		fmt.Sprintf("%s:%s:%s", WORKER_REDIS_PREFIX, STREAM_TASKS, WORKER_TASK_TYPE),
+		STREAM_GROUP,
+		STREAM_ENTRY_ID,
+		"consumer",
+		int64(DEFAULT_CLAIM_IDLE/time.Millisecond),
+	).Expect(int64(1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := WorkerHandler(func(logger Logger, args []string) error {
+		cancel()
+		return ctx.Err()
+	})
+
+	w := NewStreamWorker(1, conn, WORKER_REDIS_PREFIX, WORKER_TASK_TYPE, handler, failure)
+	w.Consumer = "consumer"
+	w.ctx = ctx
+	w.processTask(&StreamEntry{ID: STREAM_ENTRY_ID, UUID: WORKER_TASK_UUID})
+
+	if conn.Stats(release) != 1 {
+		t.Error("Interrupted task is expected to be claimable at once")
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestDaemon_requeueOwnedTasks_Stream(t *testing.T) {
+	stream := fmt.Sprintf("%s:%s:%s", CLIENT_REDIS_PREFIX, STREAM_TASKS, CLIENT_TASK_TYPE)
+
+	d := NewDaemon(CLIENT_TASK_TYPE, 1, CLIENT_REDIS_PREFIX, "")
+	d.Backend = BACKEND_STREAMS
+
+	conn := redigomock.NewConn()
+	conn.Command("XPENDING", stream, STREAM_GROUP, "-", "+", DEFAULT_PROMOTE_BATCH_SIZE, d.id).
+		Expect([]interface{}{
+			[]interface{}{[]byte(STREAM_ENTRY_ID), []byte(d.id), int64(1500), int64(1)},
+		})
+	release := conn.Command(
+		"EVALSHA",
+		streamIdleScript.Hash(),
+		1,
+		stream,
+		STREAM_GROUP,
+		STREAM_ENTRY_ID,
+		d.id,
+		int64(d.VisibilityTimeout),
+	).Expect(int64(1))
+	conn.GenericCommand("LRANGE").Expect([]interface{}{})
+	d.Dial = func() (redis.Conn, error) {
+		return conn, nil
+	}
+
+	n, err := d.requeueOwnedTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 1 || conn.Stats(release) != 1 {
+		t.Errorf("Expected the pending entry to be released, got %d", n)
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
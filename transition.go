@@ -0,0 +1,131 @@
+package redisq
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// removes a task from the processing list (along with its owner and lease) and either
+// deletes it (ARGV[2] is empty) or saves its details (unless ARGV[3] is empty) and pushes it to KEYS[3]
+// (or adds it to the KEYS[3] sorted set scored ARGV[7], if it is not empty),
+// then stores the result (unless ARGV[4] is empty) and releases the unique key (if ARGV[6] is "1"),
+// does nothing and returns 0 if the task is not in the processing list (e.g. it has been requeued)
+var finishScript = redis.NewScript(8, `
+local uuid = ARGV[1]
+if redis.call("LREM", KEYS[1], 1, uuid) == 0 then
+	return 0
+end
+redis.call("HDEL", KEYS[4], uuid)
+redis.call("ZREM", KEYS[5], uuid)
+if ARGV[2] == "" then
+	redis.call("DEL", KEYS[2])
+else
+	if ARGV[3] ~= "" then
+		redis.call("SET", KEYS[2], ARGV[3])
+	end
+	if ARGV[7] == "" then
+		redis.call("LPUSH", KEYS[3], uuid)
+	else
+		redis.call("ZADD", KEYS[3], ARGV[7], uuid)
+	end
+end
+if ARGV[4] ~= "" then
+	redis.call("SET", KEYS[6], ARGV[4], "PX", ARGV[5])
+	redis.call("LPUSH", KEYS[7], 1)
+	redis.call("PEXPIRE", KEYS[7], ARGV[5])
+end
+if ARGV[6] == "1" and redis.call("GET", KEYS[8]) == uuid then
+	redis.call("DEL", KEYS[8])
+end
+return 1
+`)
+
+// Describes how a processed task leaves its processing list, see FinishTask
+type Transition struct {
+	// processing list the task is removed from
+	Processing string
+	// list the task is pushed to, the task is deleted if empty
+	To string
+	// if not zero, To is a sorted set the task is scheduled to (see ZSET_SCHEDULED)
+	RunAt time.Time
+	// saved before the task is pushed (ignored if the task is deleted)
+	TaskDetails *TaskDetails
+	// stored for ResultTTL, if not nil
+	Result    *TaskResult
+	ResultTTL time.Duration
+	// released, if held by the task
+	UniqueKey string
+}
+
+// encodes the task details (if the task is pushed) and the result of a transition
+func (rc *RedisClient) encodeTransition(t *Transition) (details, result []byte, err error) {
+	if t.To != "" && t.TaskDetails != nil {
+		if details, err = rc.Codec.Marshal(t.TaskDetails); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if t.Result != nil {
+		if result, err = json.Marshal(t.Result); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return details, result, nil
+}
+
+// atomically applies a transition (ack, fail, retry or finalize) of a task,
+// returns ErrTaskLost if the task has left the processing list meanwhile
+func (rc *RedisClient) FinishTask(uuid string, t *Transition) error {
+	push := ""
+	to := t.Processing
+	if t.To != "" {
+		push = "1"
+		to = t.To
+	}
+
+	details, result, err := rc.encodeTransition(t)
+	if err != nil {
+		return err
+	}
+
+	release := ""
+	if t.UniqueKey != "" {
+		release = "1"
+	}
+
+	score := ""
+	if !t.RunAt.IsZero() {
+		score = fmt.Sprintf("%d", timeToScore(t.RunAt))
+	}
+
+	finished, err := redis.Bool(finishScript.Do(
+		rc.conn,
+		rc.listKey(t.Processing),
+		rc.taskKey(uuid),
+		rc.listKey(to),
+		rc.listKey(HASH_OWNERS),
+		rc.listKey(leaseSet(t.Processing)),
+		rc.resultKey(uuid),
+		rc.notifyKey(uuid),
+		rc.uniqueKey(t.UniqueKey),
+		uuid,
+		push,
+		details,
+		result,
+		int64(t.ResultTTL/time.Millisecond),
+		release,
+		score,
+	))
+	if err != nil {
+		return err
+	}
+
+	if !finished {
+		return ErrTaskLost
+	}
+
+	return nil
+}
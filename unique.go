@@ -0,0 +1,33 @@
+package redisq
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// prefix of the keys holding uuids of the pending unique tasks
+const QUEUE_UNIQUE = "unique"
+
+// how long a unique key is held if EnqueueOptions.UniqueTTL is not set
+const DEFAULT_UNIQUE_TTL = 24 * time.Hour
+
+// deletes the unique key, if it is still held by the task ARGV[1]
+var releaseUniqueScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// redis key of a unique task lock
+func (rc *RedisClient) uniqueKey(key string) string {
+	return fmt.Sprintf("%s:%s:%s:%s", rc.prefix, QUEUE_UNIQUE, rc.typeKey(), key)
+}
+
+// releases the unique key of a finished task, so that the same task can be enqueued again
+func (rc *RedisClient) ReleaseUniqueKey(key, uuid string) error {
+	_, err := releaseUniqueScript.Do(rc.conn, rc.uniqueKey(key), uuid)
+
+	return err
+}
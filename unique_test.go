@@ -0,0 +1,50 @@
+package redisq
+
+import (
+	"github.com/rafaeljusto/redigomock"
+	"testing"
+)
+
+func TestRedisClient_EnqueueTask_Unique(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.GenericCommand("EVALSHA").
+		Expect([]byte(CLIENT_TASK_UUID)).
+		Expect([]byte("pending_task_uuid"))
+
+	client := getRedisClient(conn)
+	opts := &EnqueueOptions{UUID: CLIENT_TASK_UUID, UniqueKey: "reindex:42"}
+
+	uuid, err := client.EnqueueTask([]string{"42"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uuid != CLIENT_TASK_UUID {
+		t.Errorf("Expected %+v got %+v", CLIENT_TASK_UUID, uuid)
+	}
+
+	uuid, err = client.EnqueueTask([]string{"42"}, opts)
+	if err != ErrDuplicateTask {
+		t.Errorf("Expected %+v got %+v", ErrDuplicateTask, err)
+	}
+	if uuid != "pending_task_uuid" {
+		t.Errorf("Expected uuid of the pending task, got %+v", uuid)
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestRedisClient_ReleaseUniqueKey(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.GenericCommand("EVALSHA").Expect(int64(1))
+
+	client := getRedisClient(conn)
+	if err := client.ReleaseUniqueKey("reindex:42", CLIENT_TASK_UUID); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
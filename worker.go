@@ -1,8 +1,13 @@
 package redisq
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
+	"runtime/debug"
+	"time"
 )
 
 type WorkerInterface interface {
@@ -14,80 +19,317 @@ type WorkerInterface interface {
 // Defines Worker handler function
 type WorkerHandler (func(logger Logger, args []string) error)
 
+// Handles a task given its details (implemented by WorkerHandler and HandlerFunc)
+type TaskHandler interface {
+	HandleTask(logger Logger, taskDetails *TaskDetails) error
+}
+
+// calls the handler with the task arguments
+func (h WorkerHandler) HandleTask(logger Logger, taskDetails *TaskDetails) error {
+	return h(logger, taskDetails.Arguments)
+}
+
+// Handles a task until the context is done, the context has a deadline if the task has a timeout
+// and is cancelled on Daemon shutdown (implemented by ContextWorkerHandler and ContextHandlerFunc)
+type ContextTaskHandler interface {
+	HandleTaskContext(ctx context.Context, logger Logger, taskDetails *TaskDetails) error
+}
+
+// Defines Worker handler function that can be cancelled
+type ContextWorkerHandler func(ctx context.Context, logger Logger, args []string) error
+
+// calls the handler with the task arguments
+func (h ContextWorkerHandler) HandleTaskContext(ctx context.Context, logger Logger, taskDetails *TaskDetails) error {
+	return h(ctx, logger, taskDetails.Arguments)
+}
+
+// calls the handler with the task arguments and a context without deadline
+func (h ContextWorkerHandler) HandleTask(logger Logger, taskDetails *TaskDetails) error {
+	return h.HandleTaskContext(context.Background(), logger, taskDetails)
+}
+
 type Worker struct {
 	WorkerInterface
-	id      int
-	rc      *RedisClient
-	failure chan error
-	handler WorkerHandler
-	Logger  Logger
+	id               int
+	processing       string
+	backend          Backend
+	failure          chan error
+	handler          TaskHandler
+	Logger           Logger
+	PriorityStrategy PriorityStrategy
+	// ms, how long to block on the normal priority queue once all the queues are empty
+	// (rounded up to seconds by RedisClient), then the other queues are checked again
+	PollTime  int
+	ResultTTL int
+	// when set, picked tasks are recorded as owned by it (see Daemon reaper)
+	OwnerId string
+	// ms, tasks are leased for this time while processed (disabled if zero)
+	VisibilityTimeout int
+	// failed tasks are retried up to this amount of attempts
+	MaxAttempts int
+	// ms, how often the worker moves due scheduled tasks and retries to the queues on its own
+	// (disabled if zero, Daemon runs a scheduler instead)
+	PromoteInterval int
+	// when the due tasks were last promoted
+	promotedAt time.Time
+	// when set, failed tasks are parked in the retry set for the policy delay
+	// instead of being passed to the failure worker (until MaxAttempts is reached)
+	RetryPolicy RetryPolicy
+	// policies that can be chosen per task (see EnqueueOptions.RetryPolicy)
+	RetryPolicies map[string]RetryPolicy
+	// ms, deadline of a ContextTaskHandler call (none, if zero), overridden by the task timeout
+	HandlerTimeout int
+	// parent of the handler contexts
+	ctx context.Context
+	// closed when the worker must stop picking tasks (never, if nil)
+	stop <-chan struct{}
 }
 
+// how long a worker blocks waiting for a task before checking whether it must stop
+const DEFAULT_PICK_TIMEOUT = time.Second
+
+// how many attempts a failed task gets, if not configured
+const DEFAULT_MAX_ATTEMPTS = 5
+
 // Instantiates Worker class
-// In addition it is possible to set exported parameters (Logger)
+// In addition it is possible to set exported parameters (Logger, PriorityStrategy, PollTime, ResultTTL, MaxAttempts, PromoteInterval, RetryPolicy, RetryPolicies, HandlerTimeout)
+// When PriorityStrategy is nil, only the normal priority queue is used
 func NewWorker(id int, conn redis.Conn, prefix, taskType string, handler WorkerHandler, failure chan error) (w *Worker) {
+	return NewTaskWorker(id, conn, prefix, taskType, taskHandler(handler), failure)
+}
+
+// Instantiates Worker class with any TaskHandler (e.g. HandlerFunc), see NewWorker
+func NewTaskWorker(id int, conn redis.Conn, prefix, taskType string, handler TaskHandler, failure chan error) (w *Worker) {
+	return NewBackendWorker(id, NewRedisClient(conn, prefix, taskType), handler, failure)
+}
+
+// keeps a nil handler nil as TaskHandler
+func taskHandler(handler WorkerHandler) TaskHandler {
+	if handler == nil {
+		return nil
+	}
+
+	return handler
+}
+
+// Instantiates Worker class processing the tasks of the backend (e.g. MemoryBackend)
+func NewBackendWorker(id int, backend Backend, handler TaskHandler, failure chan error) (w *Worker) {
 	w = &Worker{
-		id:      id,
-		handler: handler,
-		rc: NewRedisClient(
-			conn,
-			prefix,
-			taskType,
-		),
-		failure: failure,
-		Logger:  &NullLogger{},
+		id:               id,
+		processing:       LIST_PROCESSING,
+		handler:          handler,
+		backend:          backend,
+		failure:          failure,
+		Logger:           &NullLogger{},
+		PriorityStrategy: &StrictPriority{},
+		PollTime:         1000, //ms
+		ResultTTL:        int(DEFAULT_RESULT_TTL / time.Millisecond),
+		MaxAttempts:      DEFAULT_MAX_ATTEMPTS,
+		PromoteInterval:  int(DEFAULT_PICK_TIMEOUT / time.Millisecond),
+		ctx:              context.Background(),
 	}
 
 	return w
 }
 
-func (w *Worker) markTaskAsFailed(uuid string, err error, taskDetails *TaskDetails, permanently bool) error {
-	var list = LIST_FAILURE
+// applies a transition of the task leaving the worker processing list
+func (w *Worker) finishTask(uuid string, t *Transition) error {
+	t.Processing = w.processing
+	t.ResultTTL = w.resultTTL()
 
-	if permanently {
-		list = LIST_FAILURE_FINAL
+	if t.To == "" {
+		w.Logger.Debug("Deleting task:", uuid)
+	} else {
+		w.Logger.Debugf("Pushing %s to %s", uuid, t.To)
 	}
 
-	if taskDetails != nil {
-		taskDetails.LastError = fmt.Sprintf("%+v", err)
-		w.rc.SaveTaskDetails(uuid, taskDetails)
+	err := w.backend.FinishTask(uuid, t)
+	if err == ErrTaskLost {
+		w.Logger.Warnf("Task %s has left %s meanwhile, dropping its transition", uuid, t.Processing)
+		return err
 	}
 
-	w.Logger.Debugf("Pushing %s to %s", uuid, list)
-	if err := w.rc.PushTaskToList(uuid, list); err != nil {
-		w.Logger.Errorf("PushTaskToList(\"%s\", \"%s\") call failed: %+v", uuid, list, err)
+	if err != nil {
+		w.Logger.Errorf("FinishTask(\"%s\", \"%s\") call failed: %+v", uuid, t.To, err)
 		return err
 	}
 
 	return nil
 }
 
-func (w *Worker) processTask(uuid string) {
-	w.Logger.Debugf("Processing task id: %s", uuid)
+func (w *Worker) markTaskAsFailed(uuid string, err error, taskDetails *TaskDetails, permanently bool) error {
+	return w.finishTask(uuid, w.failureTransition(uuid, err, taskDetails, permanently))
+}
 
-	// remove from the processing list on task finish
+// moves a failed task to the failure list, the final one or the retry set
+func (w *Worker) failureTransition(uuid string, err error, taskDetails *TaskDetails, permanently bool) *Transition {
+	t := &Transition{
+		To:          LIST_FAILURE,
+		TaskDetails: taskDetails,
+	}
+
+	if taskDetails != nil {
+		taskDetails.LastError = fmt.Sprintf("%+v", err)
+	}
+
+	if permanently {
+		t.To = LIST_FAILURE_FINAL
+		if taskDetails != nil {
+			t.UniqueKey = taskDetails.UniqueKey
+			// let the producer know that the task has failed
+			if taskDetails.StoreResult {
+				t.Result = &TaskResult{Error: taskDetails.LastError}
+			}
+		}
+	} else if taskDetails != nil && taskDetails.Attempts < w.MaxAttempts {
+		// retry without going through the failure worker, if the delay is known
+		policy := w.retryPolicy(taskDetails)
+		var retryAfter *RetryAfterError
+		if errors.As(err, &retryAfter) {
+			policy = &FixedBackoff{Delay: retryAfter.Delay}
+		}
+		if policy != nil {
+			retry := w.retryTransition(uuid, taskDetails, policy)
+			t.To, t.RunAt = retry.To, retry.RunAt
+		}
+	}
+
+	return t
+}
+
+// calls the handler, returns its result if it is a ResultTaskHandler
+// A handler panic is recovered and returned as PanicError, so that the worker keeps running
+func (w *Worker) callHandler(taskDetails *TaskDetails) (result interface{}, err error) {
 	defer func() {
-		w.Logger.Debugf("Removing %s from %s", uuid, LIST_PROCESSING)
-		if err := w.rc.RemoveOneFromList(uuid, LIST_PROCESSING); err != nil {
-			w.Logger.Errorf("RemoveOneFromList(\"%s\", \"%s\") call failed: %+v", uuid, LIST_PROCESSING, err)
+		if r := recover(); r != nil {
+			result, err = nil, &PanicError{Value: r, Stack: debug.Stack()}
 		}
 	}()
 
+	if handler, ok := w.handler.(ResultTaskHandler); ok {
+		return handler.HandleTaskResult(w.Logger, taskDetails)
+	}
+
+	if handler, ok := w.handler.(ContextTaskHandler); ok {
+		return nil, w.callContextHandler(handler, taskDetails)
+	}
+
+	return nil, w.handler.HandleTask(w.Logger, taskDetails)
+}
+
+// calls the handler with a context limited by the task timeout,
+// an error returned after the deadline is a (retryable) timeout
+func (w *Worker) callContextHandler(handler ContextTaskHandler, taskDetails *TaskDetails) error {
+	timeout := w.handlerTimeout(taskDetails)
+
+	parent := w.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	defer cancel()
+
+	err := handler.HandleTaskContext(ctx, w.Logger, taskDetails)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%w after %s: %+v", ErrHandlerTimeout, timeout, err)
+	}
+
+	return err
+}
+
+// the task own timeout, if set, the worker one otherwise
+func (w *Worker) handlerTimeout(taskDetails *TaskDetails) time.Duration {
+	if taskDetails.Timeout > 0 {
+		return time.Duration(taskDetails.Timeout) * time.Millisecond
+	}
+
+	return time.Duration(w.HandlerTimeout) * time.Millisecond
+}
+
+// deletes a processed task, keeping its result if requested
+func (w *Worker) deleteTask(uuid string, taskDetails *TaskDetails, result interface{}) error {
+	t := &Transition{UniqueKey: taskDetails.UniqueKey}
+
+	if taskDetails.StoreResult {
+		t.Result = w.encodeResult(uuid, result)
+	}
+
+	return w.finishTask(uuid, t)
+}
+
+// wraps the handler result to be stored for the producer
+func (w *Worker) encodeResult(uuid string, result interface{}) *TaskResult {
+	data, err := json.Marshal(result)
+	if err != nil {
+		w.Logger.Errorf("Encoding task \"%s\" result failed: %+v", uuid, err)
+		data = nil
+	}
+
+	return &TaskResult{Result: data}
+}
+
+func (w *Worker) resultTTL() time.Duration {
+	if w.ResultTTL <= 0 {
+		return DEFAULT_RESULT_TTL
+	}
+
+	return time.Duration(w.ResultTTL) * time.Millisecond
+}
+
+// moves a task that has passed its deadline to the expired list
+func (w *Worker) markTaskAsExpired(uuid string, taskDetails *TaskDetails) error {
+	w.Logger.Debugf("Task %s expired at %s", uuid, taskDetails.ExpiresAt)
+
+	return w.finishTask(uuid, expiredTransition(taskDetails))
+}
+
+// transition of a task that has passed its deadline
+func expiredTransition(taskDetails *TaskDetails) *Transition {
+	t := &Transition{
+		To:        LIST_EXPIRED,
+		UniqueKey: taskDetails.UniqueKey,
+	}
+
+	// let the producer know that the task will never run
+	if taskDetails.StoreResult {
+		t.Result = &TaskResult{Error: fmt.Sprintf("Task expired at %s", taskDetails.ExpiresAt)}
+	}
+
+	return t
+}
+
+func (w *Worker) processTask(uuid string) {
+	w.Logger.Debugf("Processing task id: %s", uuid)
+
+	// every path below removes the task from the processing list by a single transition
 	// obtain task details
 	w.Logger.Debugf("Getting %s details", uuid)
-	taskDetails, err := w.rc.GetTaskDetails(uuid)
+	taskDetails, err := w.backend.GetTaskDetails(uuid)
 	if err != nil {
 		w.Logger.Errorf("GetTaskDetails(\"%s\") call failed: %+v", uuid, err)
 		w.markTaskAsFailed(uuid, err, nil, true)
 		return
 	}
 
+	// do not run a task that is worthless already
+	if taskDetails.IsExpired(time.Now()) {
+		w.markTaskAsExpired(uuid, taskDetails)
+		return
+	}
+
 	// Increment task attempt counter
 	taskDetails.NewAttempt()
 
 	// Try to save updated task state
 	w.Logger.Debugf("Saving %s details (new attempts count: %d)", uuid, taskDetails.Attempts)
-	err = w.rc.SaveTaskDetails(uuid, taskDetails)
+	err = w.backend.SaveTaskDetails(uuid, taskDetails)
 	if err != nil {
 		w.Logger.Errorf("SaveTaskDetails(\"%s\") call failed: %+v", uuid, err)
 		w.markTaskAsFailed(uuid, err, taskDetails, true)
@@ -96,18 +338,51 @@ func (w *Worker) processTask(uuid string) {
 
 	// handle task
 	w.Logger.Debugf("Calling %s handler with args %+v", uuid, taskDetails.Arguments)
-	err = w.handler(w.Logger, taskDetails.Arguments)
+	stopLease := w.startLease(uuid, LIST_PROCESSING, taskDetails)
+	result, err := w.callHandler(taskDetails)
+	stopLease()
 
 	if err == nil {
-		w.Logger.Debug("Deleting task:", uuid)
 		// delete a processed task, if success
-		if err := w.rc.DeleteTask(uuid); err != nil {
-			w.Logger.Errorf("DeleteTask(\"%s\") call failed: %+v", uuid, err)
-		}
+		w.deleteTask(uuid, taskDetails, result)
+	} else if w.interrupted() {
+		// the handler was cancelled on shutdown, the attempt does not count
+		w.Logger.Infof("Handler call for task \"%s\" interrupted: %+v", uuid, err)
+		taskDetails.Attempts--
+		w.finishTask(uuid, &Transition{
+			To:          priorityList(LIST_QUEUE, taskDetails.Priority),
+			TaskDetails: taskDetails,
+		})
 	} else {
-		// otherwise put the task to the failure queue
+		// otherwise put the task to the failure queue (or the final one, if it must not be retried)
 		w.Logger.Errorf("Handler call for task \"%s\" failed: %+v", uuid, err)
-		w.markTaskAsFailed(uuid, err, taskDetails, false)
+		w.markTaskAsFailed(uuid, err, taskDetails, isPermanent(err))
+	}
+}
+
+// checks whether the worker must stop picking tasks
+func (w *Worker) stopped() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// checks whether the handler context has been cancelled on shutdown
+func (w *Worker) interrupted() bool {
+	return w.ctx != nil && w.ctx.Err() == context.Canceled
+}
+
+// records the worker owner as the task owner
+func (w *Worker) setOwner(uuid string) {
+	if w.OwnerId == "" {
+		return
+	}
+
+	if err := w.backend.SetTaskOwner(uuid, w.OwnerId); err != nil {
+		w.Logger.Errorf("SetTaskOwner(\"%s\", \"%s\") call failed: %+v", uuid, w.OwnerId, err)
 	}
 }
 
@@ -118,7 +393,76 @@ func (w *Worker) GetInstanceId() int {
 
 // Get worker instance id
 func (w *Worker) GetTaskType() string {
-	return w.rc.taskType
+	return w.backend.TaskType()
+}
+
+// how long to block on the normal priority queue when all the queues are empty
+func (w *Worker) pollTime() time.Duration {
+	if w.PollTime <= 0 {
+		return DEFAULT_PICK_TIMEOUT
+	}
+
+	return time.Duration(w.PollTime) * time.Millisecond
+}
+
+// moves the due scheduled tasks and retries to the queues, at most once per PromoteInterval
+func (w *Worker) promoteDueTasks() {
+	w.promoteWith(w.backend.PromoteScheduledTasks)
+}
+
+func (w *Worker) promoteWith(promote func(now time.Time, limit int) (int, error)) {
+	if w.PromoteInterval <= 0 || time.Since(w.promotedAt) < time.Duration(w.PromoteInterval)*time.Millisecond {
+		return
+	}
+	w.promotedAt = time.Now()
+
+	for {
+		n, err := promote(time.Now(), DEFAULT_PROMOTE_BATCH_SIZE)
+		if err != nil {
+			w.Logger.Errorf("PromoteScheduledTasks() call failed: %+v", err)
+			return
+		}
+
+		if n < DEFAULT_PROMOTE_BATCH_SIZE {
+			return
+		}
+	}
+}
+
+// pick an item from the priority queues, waits until there is one,
+// returns an empty string if the worker must stop
+func (w *Worker) pickTask() (string, error) {
+	for !w.stopped() {
+		w.promoteDueTasks()
+
+		if w.PriorityStrategy == nil {
+			uuid, err := w.backend.PickTaskTimeout(LIST_QUEUE, LIST_PROCESSING, DEFAULT_PICK_TIMEOUT)
+			if err != nil || uuid != "" {
+				return uuid, err
+			}
+			continue
+		}
+
+		order := w.PriorityStrategy.Order()
+		lists := make([]string, len(order))
+		for i, priority := range order {
+			lists[i] = priorityList(LIST_QUEUE, priority)
+		}
+
+		uuid, err := w.backend.PickTaskFromLists(lists, LIST_PROCESSING)
+		if err != nil || uuid != "" {
+			return uuid, err
+		}
+
+		// all the queues are empty, block on the normal one instead of polling,
+		// so that a worker of a single priority queue picks its tasks at once
+		uuid, err = w.backend.PickTaskTimeout(LIST_QUEUE, LIST_PROCESSING, w.pollTime())
+		if err != nil || uuid != "" {
+			return uuid, err
+		}
+	}
+
+	return "", nil
 }
 
 // Run a worker (normally use a goroutine to allow concurent workers)
@@ -126,18 +470,28 @@ func (w *Worker) Run() {
 	w.Logger.Debug("started")
 	for {
 		// pick an item from the queue
-		uuid, err := w.rc.PickTask(LIST_QUEUE, LIST_PROCESSING)
+		uuid, err := w.pickTask()
+
+		// the connection may be closed on shutdown
+		if w.stopped() && (err != nil || uuid == "") {
+			w.Logger.Debug("stopped")
+			return
+		}
 
 		if err != nil {
-			w.failure <- WorkerFatalError{
+			select {
+			case w.failure <- WorkerFatalError{
 				WorkerError: WorkerError{
 					Worker: w,
 					Err:    err,
 				},
+			}:
+			case <-w.stop:
 			}
 			return
 		}
 
+		w.setOwner(uuid)
 		w.processTask(uuid)
 	}
 }
@@ -1,11 +1,14 @@
 package redisq
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/rafaeljusto/redigomock"
 	"reflect"
 	"testing"
+	"time"
 )
 
 const (
@@ -26,14 +29,6 @@ func getWorkerTaskDetails() *TaskDetails {
 
 func getRedisConnMock(t *testing.T) *redigomock.Conn {
 	conn := redigomock.NewConn()
-	// RemoveOneFromList
-	conn.Command(
-		"LREM",
-		fmt.Sprintf("%s:%s:%s", WORKER_REDIS_PREFIX, LIST_PROCESSING, WORKER_TASK_TYPE),
-		1,
-		WORKER_TASK_UUID,
-	)
-
 	// GetTaskDetails
 	originalTaskDetails := getWorkerTaskDetails()
 	jsonTaskDetails, err := json.Marshal(originalTaskDetails)
@@ -58,27 +53,51 @@ func getRedisConnMock(t *testing.T) *redigomock.Conn {
 		jsonModifiedTaskDetails,
 	)
 
-	// PushTaskToList
-	conn.Command(
-		"LPUSH",
-		fmt.Sprintf("%s:%s:%s", WORKER_REDIS_PREFIX, LIST_FAILURE_FINAL, WORKER_TASK_TYPE),
-		WORKER_TASK_UUID,
-	)
+	// FinishTask (task processed successfully)
+	expectFinishTask(conn, LIST_PROCESSING, "", nil, nil, "")
 
-	// PushTaskToList
-	conn.Command(
-		"LPUSH",
-		fmt.Sprintf("%s:%s:%s", WORKER_REDIS_PREFIX, LIST_FAILURE_FINAL, WORKER_TASK_TYPE),
-		WORKER_TASK_UUID,
-	)
+	return conn
+}
 
-	// PushTaskToList
-	conn.Command(
-		"DEL",
-		fmt.Sprintf("%s:%s:%s:%s", WORKER_REDIS_PREFIX, QUEUE_TASK, WORKER_TASK_TYPE, WORKER_TASK_UUID),
-	)
+// registers a FinishTask call moving the task from the processing list to the list (deleting it, if empty)
+func expectFinishTask(conn *redigomock.Conn, processing, to string, details, result []byte, uniqueKey string) *redigomock.Cmd {
+	push, target := "", processing
+	if to != "" {
+		push, target = "1", to
+	}
 
-	return conn
+	release := ""
+	if uniqueKey != "" {
+		release = "1"
+	}
+
+	listKey := func(list string) string {
+		return fmt.Sprintf("%s:%s:%s", WORKER_REDIS_PREFIX, list, WORKER_TASK_TYPE)
+	}
+	taskKey := func(queue, id string) string {
+		return fmt.Sprintf("%s:%s:%s:%s", WORKER_REDIS_PREFIX, queue, WORKER_TASK_TYPE, id)
+	}
+
+	return conn.Command(
+		"EVALSHA",
+		finishScript.Hash(),
+		8,
+		listKey(processing),
+		taskKey(QUEUE_TASK, WORKER_TASK_UUID),
+		listKey(target),
+		listKey(HASH_OWNERS),
+		listKey(leaseSet(processing)),
+		taskKey(QUEUE_RESULT, WORKER_TASK_UUID),
+		taskKey(QUEUE_NOTIFY, WORKER_TASK_UUID),
+		taskKey(QUEUE_UNIQUE, uniqueKey),
+		WORKER_TASK_UUID,
+		push,
+		details,
+		result,
+		int64(DEFAULT_RESULT_TTL/time.Millisecond),
+		release,
+		"",
+	).Expect(int64(1))
 }
 
 func TestWorker_processTask(t *testing.T) {
@@ -104,6 +123,55 @@ func TestWorker_processTask(t *testing.T) {
 	}
 }
 
+func TestWorker_processTask_Expired(t *testing.T) {
+	failure := make(chan error, 0)
+
+	taskDetails := getWorkerTaskDetails()
+	taskDetails.ExpiresAt = "2000-01-01T00:00:00Z"
+	jsonTaskDetails, err := json.Marshal(taskDetails)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := redigomock.NewConn()
+	conn.Command(
+		"GET",
+		fmt.Sprintf("%s:%s:%s:%s", WORKER_REDIS_PREFIX, QUEUE_TASK, WORKER_TASK_TYPE, WORKER_TASK_UUID),
+	).Expect([]byte(jsonTaskDetails))
+	expired := expectFinishTask(conn, LIST_PROCESSING, LIST_EXPIRED, nil, nil, "")
+
+	handler := WorkerHandler(func(logger Logger, args []string) error {
+		t.Error("Handler is not expected to be called for an expired task")
+		return nil
+	})
+
+	w := NewWorker(1, conn, WORKER_REDIS_PREFIX, WORKER_TASK_TYPE, handler, failure)
+	w.processTask(WORKER_TASK_UUID)
+
+	if conn.Stats(expired) != 1 {
+		t.Error("Expired task is expected to be pushed to the expired list")
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestRedisClient_FinishTask_Lost(t *testing.T) {
+	conn := redigomock.NewConn()
+	conn.GenericCommand("EVALSHA").Expect(int64(0))
+
+	client := getRedisClient(conn)
+	err := client.FinishTask(CLIENT_TASK_UUID, &Transition{Processing: LIST_PROCESSING, To: LIST_FAILURE})
+	if err != ErrTaskLost {
+		t.Errorf("Expected %+v, got %+v", ErrTaskLost, err)
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
 func TestWorker_GetInstanceId(t *testing.T) {
 	failure := make(chan error, 0)
 	conn := getFailureRedisConnMock(t)
@@ -118,6 +186,25 @@ func TestWorker_GetInstanceId(t *testing.T) {
 	}
 }
 
+func TestNewWorker_FuncHandler(t *testing.T) {
+	failure := make(chan error, 0)
+	conn := getFailureRedisConnMock(t)
+
+	// a plain func is accepted as WorkerHandler, as before TaskHandler was introduced
+	handle := func(logger Logger, args []string) error {
+		return nil
+	}
+	w := NewWorker(1, conn, WORKER_REDIS_PREFIX, WORKER_TASK_TYPE, handle, failure)
+
+	if _, ok := w.handler.(WorkerHandler); !ok {
+		t.Errorf("Expected the handler to be WorkerHandler, got %T", w.handler)
+	}
+
+	if fw := NewFailureWorker(1, conn, WORKER_REDIS_PREFIX, WORKER_TASK_TYPE, nil, failure); fw.handler != nil {
+		t.Errorf("Expected a nil handler to stay nil, got %#v", fw.handler)
+	}
+}
+
 func TestWorker_GetTaskType(t *testing.T) {
 	failure := make(chan error, 0)
 	conn := getFailureRedisConnMock(t)
@@ -130,3 +217,89 @@ func TestWorker_GetTaskType(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestWorker_callHandler_Timeout(t *testing.T) {
+	failure := make(chan error, 0)
+	conn := redigomock.NewConn()
+
+	handler := ContextWorkerHandler(func(ctx context.Context, logger Logger, args []string) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	w := NewTaskWorker(1, conn, WORKER_REDIS_PREFIX, WORKER_TASK_TYPE, handler, failure)
+	w.HandlerTimeout = 10
+
+	_, err := w.callHandler(getWorkerTaskDetails())
+	if !errors.Is(err, ErrHandlerTimeout) {
+		t.Fatalf("Expected a timeout error, got %+v", err)
+	}
+
+	var permanent *PermanentError
+	if errors.As(err, &permanent) {
+		t.Error("Timeout is expected to be retryable")
+	}
+
+	// the task timeout overrides the worker one
+	w.HandlerTimeout = 60000
+	taskDetails := getWorkerTaskDetails()
+	taskDetails.Timeout = 10
+
+	start := time.Now()
+	if _, err := w.callHandler(taskDetails); !errors.Is(err, ErrHandlerTimeout) {
+		t.Fatalf("Expected a timeout error, got %+v", err)
+	}
+
+	if time.Since(start) > time.Second {
+		t.Error("Task timeout is expected to override the worker one")
+	}
+}
+
+func TestWorker_processTask_Interrupted(t *testing.T) {
+	failure := make(chan error, 0)
+	conn := getRedisConnMock(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := ContextWorkerHandler(func(ctx context.Context, logger Logger, args []string) error {
+		cancel()
+		return ctx.Err()
+	})
+
+	// the interrupted attempt is not counted
+	taskDetails := getWorkerTaskDetails()
+	taskDetails.NewAttempt()
+	taskDetails.Attempts--
+	details, err := json.Marshal(taskDetails)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requeue := expectFinishTask(conn, LIST_PROCESSING, LIST_QUEUE, details, nil, "")
+
+	w := NewTaskWorker(1, conn, WORKER_REDIS_PREFIX, WORKER_TASK_TYPE, handler, failure)
+	w.ctx = ctx
+	w.processTask(WORKER_TASK_UUID)
+
+	if conn.Stats(requeue) != 1 {
+		t.Error("Interrupted task is expected to be returned to the queue")
+	}
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}
+
+func TestWorker_Run_Stopped(t *testing.T) {
+	failure := make(chan error, 0)
+	conn := redigomock.NewConn()
+
+	stop := make(chan struct{})
+	close(stop)
+
+	w := NewWorker(1, conn, WORKER_REDIS_PREFIX, WORKER_TASK_TYPE, nil, failure)
+	w.stop = stop
+	w.Run()
+
+	if len(conn.Errors) > 0 {
+		t.Fatal(conn.Errors)
+	}
+}